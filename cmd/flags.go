@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"sigs.k8s.io/external-dns/endpoint"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ttlValue is a pflag.Value accepting either an integer number of seconds or a Go duration string
+type ttlValue endpoint.TTL
+
+func newTTLValue(val endpoint.TTL, p *endpoint.TTL) *ttlValue {
+	*p = val
+	return (*ttlValue)(p)
+}
+
+func (t *ttlValue) String() string {
+	return strconv.FormatInt(int64(*t), 10)
+}
+
+func (t *ttlValue) Set(s string) error {
+	ttl, err := parseTTL(s)
+	if err != nil {
+		return err
+	}
+	*t = ttlValue(ttl)
+	return nil
+}
+
+func (t *ttlValue) Type() string {
+	return "ttl"
+}
+
+func parseTTL(s string) (endpoint.TTL, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("TTL must not be negative")
+		}
+		return endpoint.TTL(seconds), nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("TTL must be a number of seconds or a duration (e.g. 5m)")
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("TTL must not be negative")
+	}
+	if duration%time.Second != 0 {
+		return 0, fmt.Errorf("TTL must be a whole number of seconds")
+	}
+	return endpoint.TTL(duration / time.Second), nil
+}
+
+// Builds the domain filter from either the plain or the regex flags, which can't be combined
+// Domain filter code pulled from external-dns
+func buildDomainFilter(domains, excluded []string, regexFilter, regexExclusion string) (endpoint.DomainFilter, error) {
+	if regexFilter == "" {
+		if regexExclusion != "" {
+			return endpoint.DomainFilter{}, fmt.Errorf("--regex-domain-exclusion requires --regex-domain-filter")
+		}
+		return endpoint.NewDomainFilterWithExclusions(domains, excluded), nil
+	}
+
+	if len(domains) > 0 || len(excluded) > 0 {
+		return endpoint.DomainFilter{}, fmt.Errorf("--regex-domain-filter can't be combined with --domain-filter or --exclude-domains")
+	}
+	filterRegex, err := regexp.Compile(regexFilter)
+	if err != nil {
+		return endpoint.DomainFilter{}, fmt.Errorf("invalid --regex-domain-filter: %w", err)
+	}
+	exclusionRegex, err := regexp.Compile(regexExclusion)
+	if err != nil {
+		return endpoint.DomainFilter{}, fmt.Errorf("invalid --regex-domain-exclusion: %w", err)
+	}
+	return endpoint.NewRegexDomainFilter(filterRegex, exclusionRegex), nil
+}
+
+// Parses an indent specification of either "tab" or a number of spaces
+func parseIndent(s string) (string, error) {
+	if s == "tab" {
+		return "\t", nil
+	}
+	spaces, err := strconv.Atoi(s)
+	if err != nil || spaces < 1 {
+		return "", fmt.Errorf("indent must be \"tab\" or a positive number of spaces")
+	}
+	return strings.Repeat(" ", spaces), nil
+}
+
+// Chooses the log formatter for a --log-format of either "text" or "json"
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format \"%s\"", format)
+}
+
+// An --output ConfigMap, optionally holding only the records under a domain suffix
+type output struct {
+	name, suffix string
+}
+
+// Parses --output values of the form "name" or "name=suffix"
+// At most one output may omit its suffix, becoming the catch-all for records matching no other.
+func parseOutputs(values []string) ([]output, error) {
+	outputs := make([]output, 0, len(values))
+	names := make(map[string]bool, len(values))
+	suffixes := make(map[string]bool, len(values))
+	for _, value := range values {
+		name, suffix, _ := strings.Cut(value, "=")
+		suffix = strings.Trim(strings.ToLower(suffix), ".")
+		if name == "" {
+			return nil, fmt.Errorf("output \"%s\" has no ConfigMap name", value)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("ConfigMap \"%s\" is given more than once", name)
+		}
+		if suffixes[suffix] {
+			if suffix == "" {
+				return nil, fmt.Errorf("only one output may omit its domain suffix")
+			}
+			return nil, fmt.Errorf("domain suffix \"%s\" is given more than once", suffix)
+		}
+		names[name], suffixes[suffix] = true, true
+		outputs = append(outputs, output{name, suffix})
+	}
+	return outputs, nil
+}
+
+// Path at which a pod's service account namespace is mounted
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Returns the namespace of the pod we're running in, or an empty string if we aren't in one
+func detectNamespace() string {
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
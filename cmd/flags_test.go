@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/predakanga/external-dns-configmap-provider/pkg"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"strings"
+	"testing"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  endpoint.TTL
+		valid bool
+	}{
+		{"300", 300, true},
+		{"5m", 300, true},
+		{"1h", 3600, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"-5m", 0, false},
+		{"1500ms", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseTTL(tt.value)
+			if (err == nil) != tt.valid {
+				t.Fatalf("parseTTL(%q) = %v, want valid: %v", tt.value, err, tt.valid)
+			}
+			if got != tt.want {
+				t.Errorf("parseTTL(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationTTLIsRenderedInSeconds(t *testing.T) {
+	var ttl endpoint.TTL
+	if err := newTTLValue(60, &ttl).Set("5m"); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := pkg.ParseConfigTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := pkg.NewRenderer(tpl, pkg.StorageOptions{DefaultTTL: ttl}).Render([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "ttl 300\n") {
+		t.Errorf("config doesn't use a 300 second TTL:\n%s", config)
+	}
+}
+
+func TestBuildDomainFilter(t *testing.T) {
+	tests := []struct {
+		name                        string
+		domains, excluded           []string
+		regexFilter, regexExclusion string
+		wantErr                     string
+		matches                     string
+	}{
+		{name: "plain", domains: []string{"example.com"}, matches: "www.example.com"},
+		{name: "regex", regexFilter: `\.example\.com$`, matches: "www.example.com"},
+		{name: "conflict", domains: []string{"example.com"}, regexFilter: `\.example\.com$`, wantErr: "can't be combined"},
+		{name: "conflicting exclusion", excluded: []string{"example.com"}, regexFilter: `\.example\.com$`, wantErr: "can't be combined"},
+		{name: "invalid regex", regexFilter: `(example`, wantErr: "invalid --regex-domain-filter"},
+		{name: "invalid exclusion", regexFilter: `example`, regexExclusion: `[a-`, wantErr: "invalid --regex-domain-exclusion"},
+		{name: "exclusion without filter", regexExclusion: `example`, wantErr: "requires --regex-domain-filter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildDomainFilter(tt.domains, tt.excluded, tt.regexFilter, tt.regexExclusion)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !filter.Match(tt.matches) {
+				t.Errorf("filter doesn't match %s", tt.matches)
+			}
+		})
+	}
+}
+
+func TestLogFormatter(t *testing.T) {
+	tests := []struct {
+		format string
+		want   log.Formatter
+	}{
+		{"text", &log.TextFormatter{}},
+		{"json", &log.JSONFormatter{}},
+		{"yaml", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := logFormatter(tt.format)
+			if (err == nil) != (tt.want != nil) {
+				t.Fatalf("logFormatter(%q) = %v, want valid: %v", tt.format, err, tt.want != nil)
+			}
+			if tt.want != nil && fmt.Sprintf("%T", got) != fmt.Sprintf("%T", tt.want) {
+				t.Errorf("logFormatter(%q) = %T, want %T", tt.format, got, tt.want)
+			}
+		})
+	}
+}
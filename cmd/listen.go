@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Prefix of --listen addresses naming a Unix domain socket
+const unixSocketPrefix = "unix://"
+
+// Checks that a --listen address is well-formed, so that mistakes are reported before any other work is done
+func validateListenAddress(address string) error {
+	if path, ok := strings.CutPrefix(address, unixSocketPrefix); ok {
+		if path == "" {
+			return errors.New("socket path must not be empty")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Listens on either a TCP address or, given a unix:// prefix, a Unix domain socket
+// The socket file is removed when the listener is closed.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Removes a socket left behind by an unclean exit, which would stop us from binding
+// Anything other than a socket is left alone, in case the path was given by mistake.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// Serves requests on the listener until the server is shut down, over TLS when a certificate is given
+func serve(server *http.Server, listener net.Listener, certFile, keyFile string) error {
+	if certFile != "" {
+		return server.ServeTLS(listener, certFile, keyFile)
+	}
+	return server.Serve(listener)
+}
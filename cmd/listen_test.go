@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/predakanga/external-dns-configmap-provider/pkg"
+	"k8s.io/client-go/kubernetes/fake"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/external-dns/endpoint"
+	"testing"
+	"time"
+)
+
+func TestValidateListenAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{":8888", true},
+		{"127.0.0.1:http", true},
+		{"unix:///run/provider.sock", true},
+		{"unix://", false},
+		{"8888", false},
+		{":no-such-service", false},
+		{":99999", false},
+		{"[::1:8888", false},
+		{"[::1]:8888", true},
+		{"localhost:8888:8889", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if err := validateListenAddress(tt.address); (err == nil) != tt.valid {
+				t.Errorf("validateListenAddress(%q) = %v, want valid: %v", tt.address, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the socket file behind, as an unclean exit would
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := listen(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("listen over a stale socket failed: %v", err)
+	}
+	_ = listener.Close()
+}
+
+func TestListenKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.sock")
+	if err := os.WriteFile(path, []byte("important"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if listener, err := listen(unixSocketPrefix + path); err == nil {
+		_ = listener.Close()
+		t.Fatal("listen succeeded over a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "important" {
+		t.Errorf("regular file was changed: %q, %v", data, err)
+	}
+}
+
+// Writes a self-signed certificate for 127.0.0.1 and its key, returning their paths and the parsed certificate
+func writeTestCert(t *testing.T) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// Creates a provider backed by a fake clientset, releasing its storage when the test ends
+func newTestProvider(t *testing.T, client *fake.Clientset, opts pkg.StorageOptions) (*pkg.Provider, pkg.RecordStorage) {
+	t.Helper()
+	opts.DefaultTTL = 300
+	storage := pkg.NewStorage("dns", "default", client, opts)
+	t.Cleanup(func() {
+		_ = storage.Close(context.Background())
+	})
+	return pkg.NewProvider(endpoint.NewDomainFilter(nil), storage, pkg.ProviderOptions{}), storage
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCert(t)
+	handler, _ := newTestProvider(t, fake.NewSimpleClientset(), pkg.StorageOptions{})
+	listener, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(server, listener, certFile, keyFile)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+		<-served
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}, Timeout: 5 * time.Second}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("got status %d (TLS: %v), want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+
+	// A client which doesn't trust the certificate must refuse it
+	if resp, err := http.Get("https://" + listener.Addr().String() + "/healthz"); err == nil {
+		_ = resp.Body.Close()
+		t.Error("untrusted certificate was accepted")
+	}
+}
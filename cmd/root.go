@@ -3,24 +3,70 @@ package cmd
 import (
 	"context"
 	"errors"
+	"github.com/gin-gonic/gin"
 	"github.com/predakanga/external-dns-configmap-provider/pkg"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
 	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"syscall"
 	"time"
 )
 
 const baseLogLevel = log.InfoLevel
 
-var kubeServer, kubeConfig, targetNamespace, targetName, listenAddress string
+var kubeServer, kubeConfig, targetNamespace, listenAddress string
+var targetNames []string
 var verbosity int
+var logFormat string
+var loadRetries int
+var canonicalizeOnStart bool
+var configKey, recordsKey string
+var adoptExisting bool
+var enableLeaderElection bool
+var leaderElectionLease, leaderElectionNamespace string
 var regexDomainFilter, regexDomainExclusion string
 var domainFilter, excludeDomains []string
-var allowWildcards bool
+var allowWildcards, strictJSON, recreateOnDelete, validateCNAMETargets, addFinalizer bool
+var cnameLookupTimeout time.Duration
+var failFast bool
+var kubeConfigWait, kubeTimeout time.Duration
+var shutdownTimeout time.Duration
+var reconcileInterval time.Duration
+var pruneAfter time.Duration
+var annotateZones bool
+var verbosePanics, requireAPIVersion bool
+var groupBySetIdentifier, skipEmptyConfig bool
+var configMapLabels, configMapAnnotations map[string]string
+var fallbackName string
+var duplicateKeyStrategy, ttlConflictStrategy, indent string
+var availablePlugins []string
+var splitConfig, noRender bool
+var configTemplate string
+var ownerKind, ownerName string
+var enableReverse bool
+var reloadDeployment string
+var fallthroughZones []string
+var scopeFallthrough bool
+var zoneOrigin string
+var emitServerBlock bool
+var listenPort int
+var targetOrder string
+var targetOrderSeed int64
+var hostsReload time.Duration
+var storageKind string
+var dryRun, emitEvents bool
+var recordTypes []string
+var authToken string
+var maxRequestSize int64
+var trustedProxies []string
+var tlsCert, tlsKey string
+var unknownTypePolicy string
+var defaultTTL endpoint.TTL
+var minTTL, maxTTL endpoint.TTL
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -28,6 +74,12 @@ var rootCmd = &cobra.Command{
 	Short: "External DNS -> ConfigMap webhook",
 
 	Run: func(cmd *cobra.Command, args []string) {
+		formatter, err := logFormatter(logFormat)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid --log-format")
+		}
+		log.SetFormatter(formatter)
+
 		// Bump up the log level if requested
 		desiredLevel := baseLogLevel
 		if verbosity > 0 {
@@ -38,45 +90,250 @@ var rootCmd = &cobra.Command{
 		}
 		log.SetLevel(desiredLevel)
 		log.Infof("Log level: %v", desiredLevel)
+		// gin's debug output (e.g. the registered routes) is only wanted when tracing
+		if desiredLevel >= log.TraceLevel {
+			gin.SetMode(gin.DebugMode)
+		} else {
+			gin.SetMode(gin.ReleaseMode)
+		}
 
 		// And move on to validation
-		if targetName == "" {
+		if err := validateListenAddress(listenAddress); err != nil {
+			log.WithError(err).Fatalf("Invalid --listen address \"%s\"; expected [address]:port or unix://path", listenAddress)
+		}
+
+		if len(targetNames) == 0 {
 			log.Fatal("You must specify a name with --output")
 		}
+		outputs, err := parseOutputs(targetNames)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid --output")
+		}
+		if len(outputs) > 1 && fallbackName != "" {
+			log.Fatal("--fallback-configmap can't be used with multiple outputs")
+		}
 
-		// Domain filter code pulled from external-dns
-		var domainFilterObj endpoint.DomainFilter
-		if regexDomainFilter != "" {
-			domainFilterObj = endpoint.NewRegexDomainFilter(regexp.MustCompile(regexDomainFilter), regexp.MustCompile(regexDomainExclusion))
-		} else {
-			domainFilterObj = endpoint.NewDomainFilterWithExclusions(domainFilter, excludeDomains)
+		if !cmd.Flags().Changed("namespace") {
+			if namespace := detectNamespace(); namespace != "" {
+				log.Infof("Using the pod's namespace, %s", namespace)
+				targetNamespace = namespace
+			}
+		}
+
+		if !slices.Contains(pkg.DuplicateKeyStrategies, pkg.DuplicateKeyStrategy(duplicateKeyStrategy)) {
+			log.Fatalf("Unknown duplicate key strategy \"%s\"", duplicateKeyStrategy)
+		}
+		if !slices.Contains(pkg.TTLConflictStrategies, pkg.TTLConflictStrategy(ttlConflictStrategy)) {
+			log.Fatalf("Unknown TTL conflict strategy \"%s\"", ttlConflictStrategy)
+		}
+
+		for _, plugin := range availablePlugins {
+			if !slices.Contains(pkg.Plugins, plugin) {
+				log.Fatalf("Unknown CoreDNS plugin \"%s\" in --available-plugins", plugin)
+			}
+		}
+
+		if !slices.Contains(pkg.UnknownTypePolicies, pkg.UnknownTypePolicy(unknownTypePolicy)) {
+			log.Fatalf("Unknown record type policy \"%s\"", unknownTypePolicy)
+		}
+
+		if (ownerKind == "") != (ownerName == "") {
+			log.Fatal("--owner-kind and --owner-name must be given together")
+		}
+		if ownerKind != "" && !slices.Contains(pkg.OwnerKinds, ownerKind) {
+			log.Fatalf("Unsupported owner kind \"%s\"", ownerKind)
+		}
+
+		if scopeFallthrough {
+			if len(fallthroughZones) > 0 {
+				log.Fatal("--scope-fallthrough can't be combined with --fallthrough-zones")
+			}
+			if len(domainFilter) == 0 {
+				log.Fatal("--scope-fallthrough requires --domain-filter")
+			}
+			fallthroughZones = domainFilter
+		}
+
+		if !slices.Contains(pkg.TargetOrders, pkg.TargetOrder(targetOrder)) {
+			log.Fatalf("Unknown target order \"%s\"", targetOrder)
+		}
+
+		if emitServerBlock && zoneOrigin == "" {
+			log.Fatal("--emit-server-block requires --zone-origin, as a server block for the root zone would clash with the Corefile's own")
+		}
+		if emitServerBlock && splitConfig {
+			log.Fatal("--emit-server-block can't be used with --split-config, as each key would declare the same server block")
+		}
+		if listenPort < 1 || listenPort > 65535 {
+			log.Fatalf("Invalid --listen-port %d", listenPort)
+		}
+
+		if minTTL > 0 && maxTTL > 0 && minTTL > maxTTL {
+			log.Fatal("--min-ttl must not be greater than --max-ttl")
+		}
+		if (minTTL > 0 && defaultTTL < minTTL) || (maxTTL > 0 && defaultTTL > maxTTL) {
+			log.Fatal("--default-ttl must be within --min-ttl and --max-ttl")
+		}
+
+		if configKey == recordsKey {
+			log.Fatal("--config-key and --records-key must differ")
+		}
+
+		if loadRetries < 0 {
+			log.Fatal("--load-retries must not be negative")
+		}
+		if maxRequestSize < 0 {
+			log.Fatal("--max-request-size must not be negative")
+		}
+		if reconcileInterval < 0 {
+			log.Fatal("--reconcile-interval must not be negative")
+		}
+
+		if (tlsCert == "") != (tlsKey == "") {
+			log.Fatal("--tls-cert and --tls-key must be given together")
+		}
+		if authToken != "" {
+			log.Warn("--auth-token is set, but external-dns can't send a bearer token; its requests must pass through a proxy which adds one")
+		}
+
+		if !slices.Contains(pkg.StorageKinds, pkg.StorageKind(storageKind)) {
+			log.Fatalf("Unknown storage kind \"%s\"", storageKind)
+		}
+
+		indentStr, err := parseIndent(indent)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid --indent")
+		}
+
+		domainFilterObj, err := buildDomainFilter(domainFilter, excludeDomains, regexDomainFilter, regexDomainExclusion)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid domain filter")
+		}
+
+		// Set up the client once, after waiting for the kubeconfig, so that everything shares it
+		clientset, err := pkg.NewClientset(kubeConfig, kubeServer, kubeConfigWait)
+		if err != nil {
+			log.WithError(err).Fatal("Could not set up kubernetes client")
+		}
+
+		// Elect a leader first, as the storage defers its own writes until it's elected
+		var leader *pkg.LeaderElection
+		if enableLeaderElection {
+			if leaderElectionNamespace == "" {
+				leaderElectionNamespace = targetNamespace
+			}
+			if leader, err = pkg.NewLeaderElection(clientset, leaderElectionNamespace, leaderElectionLease); err != nil {
+				log.WithError(err).Fatal("Could not start leader election")
+			}
 		}
 
 		// Create the web server
-		storage := pkg.NewStorage(targetName, targetNamespace, kubeConfig, kubeServer)
-		handler := pkg.NewProvider(domainFilterObj, storage, allowWildcards)
+		storageOpts := pkg.StorageOptions{
+			DefaultTTL:           defaultTTL,
+			MinTTL:               minTTL,
+			MaxTTL:               maxTTL,
+			RecreateOnDelete:     recreateOnDelete,
+			Version:              cmd.Root().Version,
+			ValidateCNAMETargets: validateCNAMETargets,
+			CNAMELookupTimeout:   cnameLookupTimeout,
+			AddFinalizer:         addFinalizer,
+			FailFast:             failFast,
+			CanonicalizeOnStart:  canonicalizeOnStart,
+			PruneAfter:           pruneAfter,
+			AnnotateZones:        annotateZones,
+			Zones:                domainFilter,
+			GroupBySetIdentifier: groupBySetIdentifier,
+			SkipEmptyConfig:      skipEmptyConfig,
+			KubeTimeout:          kubeTimeout,
+			LoadRetries:          loadRetries,
+			Labels:               configMapLabels,
+			Annotations:          configMapAnnotations,
+			FallbackName:         fallbackName,
+			ConfigKey:            configKey,
+			RecordsKey:           recordsKey,
+			AdoptExisting:        adoptExisting,
+			DuplicateKeyStrategy: pkg.DuplicateKeyStrategy(duplicateKeyStrategy),
+			TTLConflictStrategy:  pkg.TTLConflictStrategy(ttlConflictStrategy),
+			Indent:               indentStr,
+			AvailablePlugins:     availablePlugins,
+			SplitConfig:          splitConfig,
+			UnknownTypePolicy:    pkg.UnknownTypePolicy(unknownTypePolicy),
+			NoRender:             noRender,
+			ConfigTemplate:       configTemplate,
+			OwnerKind:            ownerKind,
+			OwnerName:            ownerName,
+			EnableReverse:        enableReverse,
+			FallthroughZones:     fallthroughZones,
+			HostsReload:          hostsReload,
+			ZoneOrigin:           zoneOrigin,
+			EmitServerBlock:      emitServerBlock,
+			ListenPort:           listenPort,
+			TargetOrder:          pkg.TargetOrder(targetOrder),
+			TargetOrderSeed:      targetOrderSeed,
+			Kind:                 pkg.StorageKind(storageKind),
+			DryRun:               dryRun,
+			EmitEvents:           emitEvents,
+			ReloadDeployment:     reloadDeployment,
+			Leader:               leader,
+		}
+		var storage pkg.RecordStorage
+		if len(outputs) == 1 && outputs[0].suffix == "" {
+			storage = pkg.NewStorage(outputs[0].name, targetNamespace, clientset, storageOpts)
+		} else {
+			shards := make([]pkg.Shard, 0, len(outputs))
+			for _, output := range outputs {
+				shards = append(shards, pkg.Shard{
+					Storage: pkg.NewStorage(output.name, targetNamespace, clientset, storageOpts),
+					Suffix:  output.suffix,
+				})
+			}
+			storage = pkg.NewShardedStorage(shards)
+		}
+		for _, recordType := range recordTypes {
+			if !slices.Contains(storage.SupportedRecordTypes(), recordType) {
+				log.Fatalf("Unsupported record type \"%s\" in --record-types", recordType)
+			}
+		}
+		var reconciler *pkg.Reconciler
+		if reconcileInterval > 0 {
+			reconciler = pkg.NewReconciler(storage, reconcileInterval, leader)
+		}
+		handler := pkg.NewProvider(domainFilterObj, storage, pkg.ProviderOptions{
+			AllowWildcards:    allowWildcards,
+			StrictJSON:        strictJSON,
+			VerbosePanics:     verbosePanics,
+			RequireAPIVersion: requireAPIVersion,
+			RecordTypes:       recordTypes,
+			AuthToken:         authToken,
+			MaxRequestSize:    maxRequestSize,
+			TrustedProxies:    trustedProxies,
+			Leader:            leader,
+		})
 		server := http.Server{
 			Addr:    listenAddress,
 			Handler: handler,
 		}
 
-		// Signal handler to shut down gracefully
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt)
-
+		// Shut down gracefully when signalled; Kubernetes sends SIGTERM when stopping a pod
+		sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		shutdownDone := make(chan struct{})
 		go func() {
-			<-sigChan
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-
-			if err := server.Shutdown(ctx); err != nil {
-				os.Exit(0)
+			defer close(shutdownDone)
+			if err := shutdownWhenDone(sigCtx, &server, shutdownTimeout, reconciler, storage, leader); err != nil {
+				os.Exit(1)
 			}
 		}()
 
-		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.WithError(err).Fatal("Error encountered")
+		listener, err := listen(listenAddress)
+		if err != nil {
+			log.WithError(err).Fatalf("Could not listen on %s", listenAddress)
 		}
+		if serveErr := serve(&server, listener, tlsCert, tlsKey); !errors.Is(serveErr, http.ErrServerClosed) {
+			log.WithError(serveErr).Fatal("Error encountered")
+		}
+		// Wait for the storage to be released before exiting
+		<-shutdownDone
 	},
 }
 
@@ -88,16 +345,79 @@ func Execute(version string) {
 func init() {
 	rootCmd.PersistentFlags().StringVar(&kubeServer, "server", "", "The Kubernetes API server to connect to (default: auto-detect)")
 	rootCmd.PersistentFlags().StringVar(&kubeConfig, "kubeconfig", "", "Retrieve target cluster configuration from a Kubernetes configuration file (default: auto-detect)")
+	rootCmd.PersistentFlags().DurationVar(&kubeConfigWait, "kubeconfig-wait", 0, "How long to wait for the kubeconfig file to appear at startup (default: don't wait)")
+	rootCmd.PersistentFlags().DurationVar(&kubeTimeout, "k8s-timeout", 10*time.Second, "Timeout for each read or write of the ConfigMap, including retries (0 to disable)")
+	rootCmd.PersistentFlags().IntVar(&loadRetries, "load-retries", 3, "How many times to retry reading the ConfigMap after a transient API error, with exponential backoff")
 	rootCmd.PersistentFlags().CountVarP(&verbosity, "verbose", "v", "increase log verbosity")
-	rootCmd.Flags().StringVarP(&targetNamespace, "namespace", "n", "default", "namespace for the managed ConfigMap")
-	rootCmd.Flags().StringVarP(&targetName, "output", "o", "", "desired ConfigMap name")
-	rootCmd.Flags().StringVarP(&listenAddress, "listen", "l", ":8080", "[address]:[port] to listen on")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log output format: text or json")
+	rootCmd.Flags().StringVarP(&targetNamespace, "namespace", "n", "default", "namespace for the managed ConfigMap, if not the pod's own namespace when running in-cluster")
+	rootCmd.Flags().StringArrayVarP(&targetNames, "output", "o", nil, "desired ConfigMap name, optionally as name=suffix to hold only records under a domain suffix; specify multiple times to shard records across ConfigMaps")
+	rootCmd.Flags().DurationVar(&reconcileInterval, "reconcile-interval", 0, "How often to re-render the stored records, overwriting manual edits to the rendered config (default: never)")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests and the ConfigMap to be released when shutting down")
+	rootCmd.Flags().StringVarP(&listenAddress, "listen", "l", ":8080", "[address]:[port] to listen on, or unix://[path] for a Unix domain socket")
 	_ = rootCmd.MarkFlagRequired("output")
+	rootCmd.Flags().StringVar(&configKey, "config-key", "config", "ConfigMap key to write the rendered config to")
+	rootCmd.Flags().StringVar(&recordsKey, "records-key", "records", "ConfigMap key to store the records in")
+	rootCmd.Flags().BoolVar(&adoptExisting, "adopt-existing", false, "When the ConfigMap has a config but no records key, adopt the entries of its hosts block as records")
+	rootCmd.Flags().StringVar(&fallbackName, "fallback-configmap", "", "ConfigMap in the same namespace to read records from while ours, or its records key, is missing (optional)")
+	rootCmd.Flags().StringToStringVar(&configMapLabels, "label", nil, "key=value label to apply to the ConfigMap; specify multiple times for multiple labels (optional)")
+	rootCmd.Flags().StringToStringVar(&configMapAnnotations, "annotation", nil, "key=value annotation to apply to the ConfigMap, e.g. for ArgoCD tracking; specify multiple times for multiple annotations (optional)")
 
 	rootCmd.Flags().StringArrayVar(&domainFilter, "domain-filter", []string{}, "Limit possible target zones by a domain suffix; specify multiple times for multiple domains (optional)")
 	rootCmd.Flags().StringArrayVar(&excludeDomains, "exclude-domains", []string{}, "Exclude subdomains (optional)")
-	rootCmd.Flags().StringVar(&regexDomainFilter, "regex-domain-filter", "", "Limit possible domains and target zones by a Regex filter; Overrides domain-filter (optional)")
+	rootCmd.Flags().StringVar(&regexDomainFilter, "regex-domain-filter", "", "Limit possible domains and target zones by a Regex filter; can't be combined with --domain-filter or --exclude-domains (optional)")
 	rootCmd.Flags().StringVar(&regexDomainExclusion, "regex-domain-exclusion", "", "Regex filter that excludes domains and target zones matched by regex-domain-filter (optional)")
 
+	rootCmd.Flags().Var(newTTLValue(60, &defaultTTL), "default-ttl", "TTL for records without one, in seconds or as a duration (e.g. 5m)")
+	rootCmd.Flags().Var(newTTLValue(0, &minTTL), "min-ttl", "Lowest TTL records may specify, in seconds or as a duration; lower TTLs are raised to it (default: no minimum)")
+	rootCmd.Flags().Var(newTTLValue(0, &maxTTL), "max-ttl", "Highest TTL records may specify, in seconds or as a duration; higher TTLs are lowered to it (default: no maximum)")
+
+	rootCmd.Flags().BoolVar(&validateCNAMETargets, "validate-cname-targets", false, "Warn when CNAME targets don't resolve (best-effort DNS lookup at render time)")
+	rootCmd.Flags().DurationVar(&cnameLookupTimeout, "cname-lookup-timeout", 2*time.Second, "Timeout for each CNAME target lookup")
+	rootCmd.Flags().BoolVar(&failFast, "fail-fast", true, "Exit if the initial sync fails; when disabled, start up and report not-ready on /readyz instead")
+	rootCmd.Flags().BoolVar(&enableLeaderElection, "enable-leader-election", false, "Only accept changes while holding a leader election Lease, so that multiple replicas don't fight over the ConfigMap")
+	rootCmd.Flags().StringVar(&leaderElectionLease, "leader-election-lease", "external-dns-configmap-provider", "Name of the Lease used for leader election")
+	rootCmd.Flags().StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "Namespace of the Lease used for leader election (default: the ConfigMap's namespace)")
+	rootCmd.Flags().BoolVar(&canonicalizeOnStart, "canonicalize-on-start", false, "Save the records at startup, re-rendering the config and creating the ConfigMap if missing, rather than waiting for the first change")
+	rootCmd.Flags().DurationVar(&pruneAfter, "prune-after", 0, "Drop records which external-dns hasn't created, updated or adjusted within this window (default: disabled)")
+	rootCmd.Flags().BoolVar(&addFinalizer, "add-finalizer", false, "Protect the ConfigMap with a finalizer while the provider is running")
+	rootCmd.Flags().BoolVar(&recreateOnDelete, "recreate-on-delete", false, "Recreate the ConfigMap from the last known records if it is deleted while running")
+
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "Serve over TLS using this certificate file (requires --tls-key)")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "Serve over TLS using this private key file (requires --tls-cert)")
+	rootCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "CIDRs of proxies whose X-Forwarded-For headers are trusted when logging client IPs (default: trust none)")
+	rootCmd.Flags().Int64Var(&maxRequestSize, "max-request-size", 4<<20, "Largest request body accepted when modifying records, in bytes; larger ones are rejected with a 413 (0 for no limit)")
+	rootCmd.Flags().StringVar(&authToken, "auth-token", "", "Require this bearer token on requests to modify records; external-dns can't send one, so requests must pass through a proxy which adds it")
+	rootCmd.Flags().StringSliceVar(&recordTypes, "record-types", nil, "Record types to accept from external-dns; others are dropped when adjusting endpoints, except unknown types under --unknown-type-policy=store (default: all supported)")
+	rootCmd.Flags().BoolVar(&emitEvents, "emit-events", false, "Record a Kubernetes Event on the ConfigMap whenever its records change")
+	rootCmd.Flags().StringVar(&reloadDeployment, "reload-deployment", "", "Deployment in the same namespace (e.g. CoreDNS) to roll whenever the rendered config changes (optional)")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Log the rendered config instead of writing to the ConfigMap")
+	rootCmd.Flags().StringVar(&storageKind, "storage-kind", string(pkg.StorageKindConfigMap), "Kind of object to store the records and config in (configmap or secret)")
+	rootCmd.Flags().BoolVar(&enableReverse, "enable-reverse", false, "Answer reverse (PTR) lookups for records in the hosts block; only useful when their targets are in ranges CoreDNS serves")
+	rootCmd.Flags().StringSliceVar(&fallthroughZones, "fallthrough-zones", nil, "Zones for which the hosts block falls through to the next plugin (default: all zones)")
+	rootCmd.Flags().StringVar(&targetOrder, "target-order", string(pkg.TargetOrderAsc), "How to order each record's targets: asc (deterministic), source (as given by external-dns) or random (to spread load)")
+	rootCmd.Flags().Int64Var(&targetOrderSeed, "target-order-seed", 0, "Seed for --target-order=random, for a shuffle which is reproducible across restarts (default: a new seed on each start)")
+	rootCmd.Flags().StringVar(&zoneOrigin, "zone-origin", "", "Zone of the CoreDNS server block the config is imported into; template blocks are scoped to it and records outside it are skipped (optional)")
+	rootCmd.Flags().BoolVar(&emitServerBlock, "emit-server-block", false, "Wrap the config in a server block for --zone-origin, so it can be imported into the Corefile directly")
+	rootCmd.Flags().IntVar(&listenPort, "listen-port", 53, "DNS port of the server block emitted by --emit-server-block")
+	rootCmd.Flags().BoolVar(&scopeFallthrough, "scope-fallthrough", false, "Limit the hosts block's fallthrough to the --domain-filter zones, i.e. use them as --fallthrough-zones")
+	rootCmd.Flags().DurationVar(&hostsReload, "hosts-reload", 0, "How often the hosts plugin reloads its entries (default: CoreDNS's own)")
+	rootCmd.Flags().StringVar(&ownerKind, "owner-kind", "", "Kind of the resource which owns the ConfigMap when it is created (Deployment, StatefulSet, DaemonSet or Pod)")
+	rootCmd.Flags().StringVar(&ownerName, "owner-name", "", "Name of the resource which owns the ConfigMap, in the same namespace")
+	rootCmd.Flags().StringVar(&configTemplate, "config-template", "", "Render the config with the template in this file, using {% %} delimiters (default: built-in template)")
+	rootCmd.Flags().BoolVar(&noRender, "no-render", false, "Only store the records, without rendering any CoreDNS config")
+	rootCmd.Flags().BoolVar(&splitConfig, "split-config", false, "Write each record type's config to its own key (e.g. a-records, txt-records) instead of a single config key")
+	rootCmd.Flags().StringVar(&unknownTypePolicy, "unknown-type-policy", string(pkg.UnknownTypeStore), "How to handle records with types unknown to external-dns (skip, store or reject)")
+	rootCmd.Flags().StringSliceVar(&availablePlugins, "available-plugins", pkg.Plugins, "CoreDNS plugins available to the rendered config; records needing others are skipped")
+	rootCmd.Flags().StringVar(&indent, "indent", "tab", "Indentation for the rendered config: \"tab\" or a number of spaces")
+	rootCmd.Flags().BoolVar(&groupBySetIdentifier, "group-by-set-identifier", false, "Group hosts entries by set identifier, with a comment labelling each group")
+	rootCmd.Flags().BoolVar(&skipEmptyConfig, "skip-empty-config", false, "Keep the previous config rather than writing one containing no records")
+	rootCmd.Flags().StringVar(&ttlConflictStrategy, "ttl-conflict-strategy", string(pkg.TTLConflictLowest), "How to render records sharing a name and type but not a TTL: lowest (use the lowest TTL for all) or split (keep each record's own TTL)")
+	rootCmd.Flags().StringVar(&duplicateKeyStrategy, "duplicate-key-strategy", string(pkg.DuplicateKeyLast), "How to merge records sharing a name, type and set identifier: keep, union, last or reject")
+	rootCmd.Flags().BoolVar(&annotateZones, "annotate-zones", false, "Include each record's zone (the matching domain-filter suffix) in the stored records")
+
 	rootCmd.Flags().BoolVar(&allowWildcards, "allow-wildcards", false, "Allow wildcard entries (please ensure there is no overlap between entries)")
+	rootCmd.Flags().BoolVar(&verbosePanics, "verbose-panics", false, "Include the panic's message in the error body returned when a handler panics, rather than a generic one")
+	rootCmd.Flags().BoolVar(&requireAPIVersion, "require-api-version", false, "Reject mutating requests whose Accept header excludes the webhook API version (406), or whose Content-Type isn't it (415)")
+	rootCmd.Flags().BoolVar(&strictJSON, "strict-json", false, "Reject webhook requests containing unknown fields (helps catch external-dns version mismatches)")
 }
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"context"
+	"github.com/predakanga/external-dns-configmap-provider/pkg"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Shuts down once ctx is done, e.g. on SIGTERM: stops accepting requests, gives those in flight until the timeout
+// to finish, then releases the ConfigMap and the Lease. Returns the error from draining the server, if any.
+func shutdownWhenDone(ctx context.Context, server *http.Server, timeout time.Duration, reconciler *pkg.Reconciler, storage pkg.RecordStorage, leader *pkg.LeaderElection) error {
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.WithError(shutdownErr).Error("Could not shut down the server cleanly")
+	}
+	if reconciler != nil {
+		reconciler.Close()
+	}
+	// Close waits for any in-progress write, so a plan received just before the signal isn't lost
+	if err := storage.Close(shutdownCtx); err != nil {
+		log.WithError(err).Error("Could not release ConfigMap")
+	}
+	if leader != nil {
+		leader.Close()
+	}
+	return shutdownErr
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"github.com/predakanga/external-dns-configmap-provider/pkg"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"sigs.k8s.io/external-dns/endpoint"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsAndReleases(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	leader, err := pkg.NewLeaderElection(client, "default", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the Lease to be acquired", leader.IsLeader)
+
+	// The storage and leader election are released by the shutdown itself, so aren't cleaned up here
+	storage := pkg.NewStorage("dns", "default", client, pkg.StorageOptions{DefaultTTL: 300, AddFinalizer: true})
+	err = storage.Modify(context.Background(), func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), "dns", metav1.GetOptions{})
+	if err != nil || len(cm.Finalizers) == 0 {
+		t.Fatalf("ConfigMap wasn't given a finalizer: %v", err)
+	}
+
+	// A request still in flight when the signal arrives must be allowed to finish
+	started, release := make(chan struct{}), make(chan struct{})
+	provider := pkg.NewProvider(endpoint.NewDomainFilter(nil), storage, pkg.ProviderOptions{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+			r.URL.Path = "/healthz"
+		}
+		provider.ServeHTTP(w, r)
+	})}
+	listener, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = serve(server, listener, "", "")
+	}()
+	slowStatus := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			slowStatus <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		slowStatus <- resp.StatusCode
+	}()
+	<-started
+
+	sigCtx, sendSignal := context.WithCancel(context.Background())
+	const timeout = 5 * time.Second
+	shutdownErr := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		shutdownErr <- shutdownWhenDone(sigCtx, server, timeout, nil, storage, leader)
+	}()
+	sendSignal()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > timeout {
+		t.Errorf("shutdown took %v, longer than the %v timeout", elapsed, timeout)
+	}
+	if status := <-slowStatus; status != http.StatusOK {
+		t.Errorf("in-flight request got status %d, want 200", status)
+	}
+
+	cm, err = client.CoreV1().ConfigMaps("default").Get(context.Background(), "dns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Finalizers) != 0 {
+		t.Errorf("ConfigMap still has finalizers %v", cm.Finalizers)
+	}
+	lease, err := client.CoordinationV1().Leases("default").Get(context.Background(), "provider", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" {
+		t.Errorf("Lease is still held by %s", *holder)
+	}
+	if leader.IsLeader() {
+		t.Error("still leading after shutdown")
+	}
+}
+
+// Polls cond until it holds, failing the test if it doesn't within a few seconds
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"bufio"
+	"net"
+	"sigs.k8s.io/external-dns/endpoint"
+	"strings"
+)
+
+// Parses the inline entries of the hosts block in a config, for adopting a hand-written config's records
+// This is deliberately conservative: only the first hosts block is read, and anything in it other than
+// "address name..." entries (e.g. directives) is ignored.
+func parseHostsBlock(config string) []*endpoint.Endpoint {
+	var records []*endpoint.Endpoint
+	byKey := make(map[string]*endpoint.Endpoint)
+	inBlock := false
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !inBlock {
+			inBlock = fields[0] == "hosts" && fields[len(fields)-1] == "{"
+			continue
+		}
+		if fields[0] == "}" {
+			break
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		recordType := endpoint.RecordTypeAAAA
+		if ip.To4() != nil {
+			recordType = endpoint.RecordTypeA
+		}
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			key := name + "/" + recordType
+			if ep, ok := byKey[key]; ok {
+				ep.Targets = append(ep.Targets, fields[0])
+				continue
+			}
+			ep := endpoint.NewEndpoint(name, recordType, fields[0])
+			byKey[key] = ep
+			records = append(records, ep)
+		}
+	}
+	return records
+}
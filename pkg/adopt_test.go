@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"testing"
+)
+
+func TestParseHostsBlock(t *testing.T) {
+	config := `hosts /etc/coredns/extra.hosts {
+	10.0.0.1 a.example.com
+	2001:db8::1 A.Example.com. # the same host over IPv6
+	10.0.0.2 b.example.com
+	ttl 60
+	fallthrough
+}
+template IN A example.org {
+	answer "{{ .Name }} 60 IN A 10.0.0.3"
+}
+`
+	want := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeAAAA, "2001:db8::1"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+	}
+	got := parseHostsBlock(config)
+	if !slices.EqualFunc(got, want, func(a, b *endpoint.Endpoint) bool { return a.String() == b.String() }) {
+		t.Errorf("parsed %v, want %v", got, want)
+	}
+}
+
+func TestAdoptExisting(t *testing.T) {
+	config := "hosts {\n\t10.0.0.1 a.example.com\n\t10.0.0.2 b.example.com\n\tfallthrough\n}\n"
+	tests := []struct {
+		name  string
+		adopt bool
+		want  []string
+	}{
+		{"ignored by default", false, nil},
+		{"adopted", true, []string{"a.example.com", "b.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300, AdoptExisting: tt.adopt}, testConfigMap(testName, map[string]string{"config": config}))
+			if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, tt.want) {
+				t.Errorf("loaded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"strconv"
+)
+
+// Provider-specific property set by external-dns on CNAMEs which should be served as an alias,
+// e.g. at a zone apex where a real CNAME isn't allowed
+const providerSpecificAlias = "alias"
+
+// Replaces alias records with A and AAAA records pointing at their targets' addresses
+// CoreDNS has no notion of an alias, so only aliases to records we hold can be flattened; others are skipped.
+func flattenAliases(records []*endpoint.Endpoint, skipped *skipList) []*endpoint.Endpoint {
+	addresses := make(map[string][]*endpoint.Endpoint)
+	for _, ep := range records {
+		if ep.RecordType == endpoint.RecordTypeA || ep.RecordType == endpoint.RecordTypeAAAA {
+			addresses[ep.DNSName] = append(addresses[ep.DNSName], ep)
+		}
+	}
+
+	flattened := make([]*endpoint.Endpoint, 0, len(records))
+	for _, ep := range records {
+		if !isAlias(ep) {
+			flattened = append(flattened, ep)
+			continue
+		}
+		byType := map[string]*endpoint.Endpoint{}
+		for _, target := range ep.Targets {
+			for _, address := range addresses[canonicalName(target)] {
+				if byType[address.RecordType] == nil {
+					byType[address.RecordType] = endpoint.NewEndpointWithTTL(ep.DNSName, address.RecordType, ep.RecordTTL)
+					byType[address.RecordType].SetIdentifier = ep.SetIdentifier
+					byType[address.RecordType].ProviderSpecific = slices.Clone(ep.ProviderSpecific)
+				}
+				byType[address.RecordType].Targets = append(byType[address.RecordType].Targets, address.Targets...)
+			}
+		}
+		if len(byType) == 0 {
+			recordLog(ep).Warnf("Alias \"%s\" points at no A or AAAA records that are stored here, so can't be flattened. Skipping.", ep.DNSName)
+			skipped.add(ep, skipReasonUnresolvableAlias)
+			continue
+		}
+		for _, recordType := range []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA} {
+			if alias, ok := byType[recordType]; ok {
+				flattened = append(flattened, alias)
+			}
+		}
+	}
+	return flattened
+}
+
+// Whether a record is flagged as an alias
+func isAlias(ep *endpoint.Endpoint) bool {
+	if ep.RecordType != endpoint.RecordTypeCNAME {
+		return false
+	}
+	value, ok := ep.GetProviderSpecificProperty(providerSpecificAlias)
+	if !ok {
+		return false
+	}
+	alias, _ := strconv.ParseBool(value)
+	return alias
+}
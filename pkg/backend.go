@@ -1,41 +1,117 @@
 package pkg
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	stderrors "errors"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"maps"
+	"os"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/source"
 	"slices"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 )
 
-const configTpl = `
-{%- with .standard -%}
+// CoreDNS plugins which the rendered config may use
+const (
+	PluginHosts    = "hosts"
+	PluginTemplate = "template"
+)
+
+// Plugins lists the CoreDNS plugins which the rendered config may use
+var Plugins = []string{PluginHosts, PluginTemplate}
+
+// Record types which can be rendered for non-wildcard records
+var supportedRecordTypes = []string{endpoint.RecordTypeA, endpoint.RecordTypeAAAA, endpoint.RecordTypeTXT, "SPF", endpoint.RecordTypeCNAME, endpoint.RecordTypeSRV, endpoint.RecordTypeMX, endpoint.RecordTypeNS}
+
+// Record types which the hosts plugin can't serve, so are always rendered using the template plugin
+var templateOnlyRecordTypes = []string{endpoint.RecordTypeTXT, endpoint.RecordTypeCNAME, endpoint.RecordTypeSRV, endpoint.RecordTypeMX, endpoint.RecordTypeNS}
+
+// Provider-specific properties recognized when rendering; any others are stored but ignored
+const (
+	// Orders rendering; higher priorities are rendered first
+	providerSpecificPriority = "configmap/priority"
+	// Overrides the record's TTL, in seconds
+	providerSpecificTTL = "configmap/ttl"
+	// When "true", keeps the record in the registry but leaves it out of the rendered config
+	providerSpecificExclude = "configmap/exclude"
+)
+
+// The most data a ConfigMap or Secret can hold (1 MiB)
+const maxObjectSize = 1 << 20
+
+// ConfigMap keys used when none are configured
+const (
+	defaultConfigKey  = "config"
+	defaultRecordsKey = "records"
+)
+
+// Annotation holding a checksum of the rendered config, on both the ConfigMap and any reloaded Deployment's pods
+const configHashAnnotation = "configmap-provider/config-hash"
+
+// Finalizer applied to the ConfigMap when requested, protecting it from accidental deletion
+const finalizerName = "external-dns-configmap-provider/protection"
+
+const configTpl = `# Generated by external-dns-configmap-provider v{% .version %}
+{% with .standard -%}
 hosts {
-{%- range . %}
-	{% index .Targets 0 %} {% .DNSName %}
+{%- $group := "" %}
+{%- range $i, $record := . %}
+{%- if and $.groupBySetIdentifier (or (eq $i 0) (ne .SetIdentifier $group)) %}
+{%- $group = .SetIdentifier %}
+
+	# Set identifier: {% or .SetIdentifier "(none)" %}
+{%- end %}
+{%- range .Targets %}
+	{% . %} {% $record.DNSName %}
+{%- end %}
 {%- end %}
 
-	ttl 60
+	ttl {% $.defaultTTL %}
+{%- if $.hostsReload %}
+	reload {% $.hostsReload %}
+{%- end %}
+{%- if not $.enableReverse %}
 	no_reverse
-	fallthrough
+{%- end %}
+	fallthrough{% range $.fallthroughZones %} {% . %}{% end %}
 }
 {%- end %}
 
+{% range $record := .template -%}
+template IN {% queryType .RecordType %} {% or $.zoneOrigin .DNSName %} {
+	match "{% matchRegex .DNSName %}"
+	{%- range .Targets %}
+	answer "{{ .Name }} {% or $record.RecordTTL $.defaultTTL %} IN {% $record.RecordType %} {% rdata $record.RecordType . %}"
+	{%- end %}
+
+	fallthrough
+}
+{% end %}
 {% range $record := .wildcard -%}
-template IN {% .RecordType %} {% slice .DNSName 2 %} {
-	answer "{{ .Name }} {% or .RecordTTL 60 %} IN {% .RecordType %} {% index .Targets 0 %}"
+template IN {% queryType .RecordType %} {% or $.zoneOrigin (slice .DNSName 2) %} {
+	match "{% matchSubdomainRegex (slice .DNSName 2) %}"
+	answer "{{ .Name }} {% or .RecordTTL $.defaultTTL %} IN {% .RecordType %} {% rdata .RecordType (index .Targets 0) %}"
+	{%- if gt (len .Targets) 1 %}
 	{%- range slice .Targets 1 %}
-	additional "{{ .Name }} {% or $record.RecordTTL 60 %} IN {% $record.RecordType %} {% . %}"
+	additional "{{ .Name }} {% or $record.RecordTTL $.defaultTTL %} IN {% $record.RecordType %} {% rdata $record.RecordType . %}"
+	{%- end %}
 	{%- end %}
 
 	fallthrough
@@ -43,150 +119,860 @@ template IN {% .RecordType %} {% slice .DNSName 2 %} {
 {% end %}
 `
 
+// StorageOptions controls how records are rendered into the ConfigMap
+type StorageOptions struct {
+	// DefaultTTL is used for records which don't specify their own TTL
+	DefaultTTL endpoint.TTL
+	// MinTTL and MaxTTL bound the TTLs which records may specify (disabled if zero)
+	MinTTL, MaxTTL endpoint.TTL
+	// TTLConflictStrategy controls how records sharing a name and type, but not a TTL, are rendered (default: lowest)
+	TTLConflictStrategy TTLConflictStrategy
+	// LoadRetries is how many times Load retries reading the ConfigMap after a transient error, with exponential backoff
+	LoadRetries int
+	// KubeTimeout bounds each Load, Save and Close, including any retries (disabled if zero)
+	KubeTimeout time.Duration
+	// FailFast exits if the initial sync fails, rather than starting up unready
+	FailFast bool
+	// CanonicalizeOnStart saves the records at startup, re-rendering the config and creating the ConfigMap if needed,
+	// rather than waiting for the first change
+	CanonicalizeOnStart bool
+	// PruneAfter drops records which external-dns hasn't created, updated or adjusted within the window (disabled if zero)
+	PruneAfter time.Duration
+	// AnnotateZones adds the zone each record belongs to when storing the records
+	AnnotateZones bool
+	// Zones managed by the provider, as configured by the domain filter
+	Zones []string
+	// GroupBySetIdentifier renders standard records grouped by their set identifier, with a comment labelling each group
+	GroupBySetIdentifier bool
+	// SkipEmptyConfig keeps the previous config, rather than writing one which contains no records
+	SkipEmptyConfig bool
+	// AvailablePlugins restricts the CoreDNS plugins which will be rendered (default: all)
+	AvailablePlugins []string
+	// SplitConfig writes each record type's config to its own key (e.g. a-records), rather than a single config key
+	SplitConfig bool
+	// UnknownTypePolicy controls how records with types unknown to external-dns are handled
+	UnknownTypePolicy UnknownTypePolicy
+	// NoRender stores only the records, leaving rendering the config to other tooling
+	NoRender bool
+	// ConfigTemplate is the path of a template to render the config with, in place of the embedded default
+	ConfigTemplate string
+	// OwnerKind and OwnerName identify a resource in the same namespace which owns the ConfigMap when it is created
+	OwnerKind, OwnerName string
+	// Kind of object to store the records in (default: ConfigMap)
+	Kind StorageKind
+	// DryRun logs the rendered config rather than writing anything
+	DryRun bool
+	// EmitEvents records a Kubernetes Event against the ConfigMap whenever its records change
+	EmitEvents bool
+	// ReloadDeployment is a Deployment in the same namespace to roll whenever the rendered config changes
+	ReloadDeployment string
+	// EnableReverse lets the hosts plugin answer PTR queries for its records
+	// This only makes sense where the targets are within ranges that CoreDNS is authoritative for
+	EnableReverse bool
+	// TargetOrder is how each record's targets are ordered when rendered (default: asc)
+	TargetOrder TargetOrder
+	// TargetOrderSeed seeds the random target order, for a shuffle which is reproducible across restarts
+	// (default: a new seed each time the provider starts)
+	TargetOrderSeed int64
+	// ZoneOrigin is the zone of the CoreDNS server block which the config is imported into
+	// Template blocks are scoped to it, and records outside of it are skipped. (default: none)
+	ZoneOrigin string
+	// EmitServerBlock wraps the config in a server block for ZoneOrigin, which must be set, so that it can be
+	// imported into the Corefile by itself rather than inside an existing server block
+	EmitServerBlock bool
+	// ListenPort is the port of the server block emitted with EmitServerBlock (default: 53)
+	ListenPort int
+	// FallthroughZones limits the hosts block's fallthrough to these zones (default: all zones)
+	FallthroughZones []string
+	// HostsReload is how often the hosts plugin checks for changes to its entries (default: CoreDNS's own)
+	HostsReload time.Duration
+	// Indent replaces the tabs used to indent the rendered config (default: tab)
+	Indent string
+	// DuplicateKeyStrategy merges records sharing a DNSName, RecordType and SetIdentifier when saving (default: last)
+	DuplicateKeyStrategy DuplicateKeyStrategy
+	// ConfigKey is the ConfigMap key which the rendered config is written to (default: config)
+	ConfigKey string
+	// RecordsKey is the ConfigMap key which the records are stored in (default: records)
+	RecordsKey string
+	// AdoptExisting seeds the records from the config's hosts block when the records key is missing,
+	// e.g. for a hand-written config which is being migrated to the provider
+	AdoptExisting bool
+	// FallbackName is a ConfigMap in the same namespace to read records from when ours, or its records key, is missing
+	FallbackName string
+	// Labels and Annotations are applied to the ConfigMap, e.g. for ArgoCD tracking, without removing any others
+	Labels, Annotations map[string]string
+	// AddFinalizer protects the ConfigMap with a finalizer while the provider is running
+	AddFinalizer bool
+	// RecreateOnDelete restores the last known records if the ConfigMap is deleted while running
+	RecreateOnDelete bool
+	// ValidateCNAMETargets looks up CNAME targets at render time, warning about those which don't resolve
+	ValidateCNAMETargets bool
+	// CNAMELookupTimeout bounds each CNAME target lookup
+	CNAMELookupTimeout time.Duration
+	// Version is recorded in the header of the rendered config
+	Version string
+	// Leader, if set, restricts writes to the replica holding the leader election Lease
+	// Writes made at startup, such as CanonicalizeOnStart's, are deferred until we're elected.
+	Leader *LeaderElection
+}
+
+// Mutable state, shared between copies of a Storage
+type storageState struct {
+	sync.Mutex
+	// Whether we've successfully read or written the ConfigMap
+	seen bool
+	// Whether the ConfigMap was found to be deleted, and is awaiting recreation
+	missing bool
+	// The records most recently read from or written to the ConfigMap
+	lastKnown []*endpoint.Endpoint
+	// Why the initial sync failed, if it did and we haven't recovered yet
+	syncErr error
+	// When the records were last successfully saved
+	lastSave time.Time
+	// The records left out of the most recently rendered config
+	skipped skipList
+	// When external-dns last asked for each record to be adjusted, by record key, for pruning
+	sightings map[string]time.Time
+	// Serializes modifications, so that concurrent changes can't clobber each other's records
+	modifying sync.Mutex
+}
+
 type Storage struct {
 	name, namespace string
-	kubeConfig      *rest.Config
-	configTemplate  *template.Template
+	clientset       kubernetes.Interface
+	objects         objectClient
+	renderer        *Renderer
+	opts            StorageOptions
+	state           storageState
+	cache           configMapCache
+	clock           func() time.Time
+	broadcaster     record.EventBroadcaster
+	recorder        record.EventRecorder
 }
 
-func NewStorage(name, namespace, configPath, server string) Storage {
-	// Set up the kubernetes config once at startup
-	// TODO: Use a cache/watcher to minimize roundtrips
-	config, err := source.GetRestConfig(configPath, server)
+// NewClientset sets up the kubernetes client once at startup, to be shared by the storage and leader election
+// When wait is set, the kubeconfig file may take up to that long to appear.
+func NewClientset(configPath, server string, wait time.Duration) (kubernetes.Interface, error) {
+	if configPath != "" && wait > 0 {
+		if err := waitForFile(configPath, wait); err != nil {
+			return nil, errors.Wrapf(err, "Kubeconfig %s did not appear within %v", configPath, wait)
+		}
+	}
+	config, err := loadRestConfig(configPath, server)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not load kubeconfig")
+	}
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.WithError(err).Fatal("Could not load kubeconfig")
+		return nil, errors.Wrap(err, "Could not create kubernetes client")
+	}
+	return clientset, nil
+}
+
+func NewStorage(name, namespace string, clientset kubernetes.Interface, opts StorageOptions) *Storage {
+	return newStorage(name, namespace, clientset, opts)
+}
+
+// Creates a Storage using the given client, e.g. a fake one in tests
+func newStorage(name, namespace string, clientset kubernetes.Interface, opts StorageOptions) *Storage {
+	if opts.ConfigKey == "" {
+		opts.ConfigKey = defaultConfigKey
+	}
+	if opts.RecordsKey == "" {
+		opts.RecordsKey = defaultRecordsKey
 	}
 
-	// Use custom delimiters for our template because the DNS responses use the standard ones
-	tpl := template.New("config").Delims("{%", "%}")
-	if _, err := tpl.Parse(configTpl); err != nil {
+	tplText := ""
+	if opts.ConfigTemplate != "" {
+		data, err := os.ReadFile(opts.ConfigTemplate)
+		if err != nil {
+			log.WithError(err).Fatalf("Could not read config template %s", opts.ConfigTemplate)
+		}
+		tplText = string(data)
+	}
+	tpl, err := ParseConfigTemplate(tplText)
+	if err != nil {
 		log.WithError(err).Fatal("Could not parse config template")
 	}
 
-	toRet := Storage{
+	toRet := &Storage{
 		name,
 		namespace,
-		config,
-		tpl,
+		clientset,
+		newObjectClient(opts.Kind, clientset, namespace),
+		NewRenderer(tpl, opts),
+		opts,
+		storageState{},
+		configMapCache{},
+		time.Now,
+		nil,
+		nil,
 	}
+	toRet.startInformer()
+	toRet.startEvents()
 
-	// Do an initial load and save to canonicalize the config
-	records, err := toRet.Load(context.Background())
-	if err != nil {
-		log.WithError(err).Fatal("Loading ConfigMap failed")
-	}
-	if err := toRet.Save(context.Background(), records); err != nil {
-		log.WithError(err).Fatal("Saving ConfigMap failed")
+	// Do an initial load, and optionally a save to canonicalize the config
+	ctx, cancel := toRet.withTimeout(context.Background())
+	defer cancel()
+	if err := toRet.sync(ctx); err != nil {
+		if opts.FailFast {
+			log.WithError(err).Fatal("Initial sync failed")
+		}
+		log.WithError(err).Error("Initial sync failed. Starting up unready.")
+		toRet.state.syncErr = err
 	}
 
 	return toRet
 }
 
-func (s Storage) client() (*kubernetes.Clientset, error) {
-	return kubernetes.NewForConfig(s.kubeConfig)
+// Bounds Kubernetes operations by the configured timeout, if any, while still honouring the parent's cancellation
+func (s *Storage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.opts.KubeTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.opts.KubeTimeout)
 }
 
-func (s Storage) Load(ctx context.Context) ([]*endpoint.Endpoint, error) {
-	c, err := s.client()
-	if err != nil {
-		return nil, errors.Wrap(err, "Could not connect to kubernetes")
+// Loads the kubernetes client config
+// When no kubeconfig or server is given, the in-cluster config is preferred over ~/.kube/config
+func loadRestConfig(configPath, server string) (*rest.Config, error) {
+	if configPath == "" && server == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			log.Info("Using in-cluster config")
+			return config, nil
+		}
+		if !stderrors.Is(err, rest.ErrNotInCluster) {
+			return nil, errors.Wrap(err, "Could not load in-cluster config")
+		}
+	}
+	return source.GetRestConfig(configPath, server)
+}
+
+// Waits for a file to exist, e.g. a kubeconfig which is mounted slightly after startup
+func waitForFile(path string, timeout time.Duration) error {
+	return wait.PollUntilContextTimeout(context.Background(), 500*time.Millisecond, timeout, true, func(context.Context) (bool, error) {
+		if _, err := os.Stat(path); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		log.Debugf("Waiting for kubeconfig %s to appear", path)
+		return false, nil
+	})
+}
+
+// Checks that the ConfigMap can be read, and with CanonicalizeOnStart, rewrites it in canonical form
+// Saving skips the update when nothing has changed, so a restart doesn't by itself cause CoreDNS to reload.
+func (s *Storage) sync(ctx context.Context) error {
+	if !s.opts.CanonicalizeOnStart {
+		_, err := s.Load(ctx)
+		return err
+	}
+	if s.opts.Leader != nil {
+		// Only the leader may write, so canonicalize whenever we're elected instead
+		s.opts.Leader.OnStartedLeading(s.canonicalize)
+		_, err := s.Load(ctx)
+		return err
 	}
-	cm, err := c.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	return s.Modify(ctx, func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return records, nil
+	})
+}
+
+// Rewrites the ConfigMap in canonical form, as sync does without leader election
+func (s *Storage) canonicalize() {
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+
+	if err := s.Modify(ctx, func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return records, nil
+	}); err != nil {
+		log.WithError(err).Errorf("Could not canonicalize ConfigMap %s/%s", s.namespace, s.name)
+	}
+}
+
+// Whether this replica may write the ConfigMap, i.e. it holds the Lease if leader election is enabled
+func (s *Storage) mayWrite() bool {
+	return s.opts.Leader == nil || s.opts.Leader.IsLeader()
+}
+
+// Modify loads the records, applies fn to them and saves the result
+// Modifications are serialized, so the records can't change between the load and the save.
+// If another writer updates the ConfigMap in the meantime, the whole sequence is retried against its update,
+// so fn may be called more than once. Errors returned by fn are passed through as-is.
+func (s *Storage) Modify(ctx context.Context, fn func([]*endpoint.Endpoint) ([]*endpoint.Endpoint, error)) error {
+	s.state.modifying.Lock()
+	defer s.state.modifying.Unlock()
+
+	// The first attempt uses the cached ConfigMap, while retries fetch it afresh in case the cache is what's stale
+	live := false
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		defer func() { live = true }()
+
+		records, err := s.load(ctx, live)
+		if err != nil {
+			return errors.Wrap(err, "Loading ConfigMap failed")
+		}
+		if records, err = fn(records); err != nil {
+			return err
+		}
+		if err := s.store(ctx, records, live); err != nil {
+			return errors.Wrap(err, "Saving ConfigMap failed")
+		}
+		return nil
+	})
+}
+
+// SupportedRecordTypes lists the record types which will be rendered
+func (s *Storage) SupportedRecordTypes() []string {
+	return slices.Clone(supportedRecordTypes)
+}
+
+// Features reports which optional storage behaviours are enabled
+func (s *Storage) Features() map[string]bool {
+	return map[string]bool{
+		"addFinalizer":         s.opts.AddFinalizer,
+		"annotateZones":        s.opts.AnnotateZones,
+		"canonicalizeOnStart":  s.opts.CanonicalizeOnStart,
+		"enableReverse":        s.opts.EnableReverse,
+		"groupBySetIdentifier": s.opts.GroupBySetIdentifier,
+		"hostsReload":          s.opts.HostsReload > 0,
+		"noRender":             s.opts.NoRender,
+		"prune":                s.opts.PruneAfter > 0,
+		"recreateOnDelete":     s.opts.RecreateOnDelete,
+		"reloadDeployment":     s.opts.ReloadDeployment != "",
+		"skipEmptyConfig":      s.opts.SkipEmptyConfig,
+		"splitConfig":          s.opts.SplitConfig,
+		"validateCNAMETargets": s.opts.ValidateCNAMETargets,
+	}
+}
+
+func (s *Storage) unknownTypePolicy() UnknownTypePolicy {
+	return s.opts.UnknownTypePolicy
+}
+
+// StorageStatus summarizes the stored records, as returned by GET /status
+type StorageStatus struct {
+	// Records counts the stored records by type
+	Records map[string]int `json:"records"`
+	// LastSave is when the records were last successfully saved, if they have been
+	LastSave *time.Time `json:"lastSave,omitempty"`
+}
+
+// Status summarizes the records as last read or written
+func (s *Storage) Status() StorageStatus {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	status := StorageStatus{Records: map[string]int{}}
+	for _, ep := range s.state.lastKnown {
+		status.Records[ep.RecordType]++
+	}
+	if !s.state.lastSave.IsZero() {
+		lastSave := s.state.lastSave
+		status.LastSave = &lastSave
+	}
+	return status
+}
+
+// Ready returns an error if the storage isn't yet usable
+func (s *Storage) Ready() error {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	return s.state.syncErr
+}
+
+func (s *Storage) client() kubernetes.Interface {
+	return s.clientset
+}
+
+// Load returns the stored records, reading the ConfigMap from the cache where possible
+func (s *Storage) Load(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return s.load(ctx, false)
+}
+
+// Reads the stored records, bypassing the cache when live is set
+func (s *Storage) load(ctx context.Context, live bool) ([]*endpoint.Endpoint, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var cm *corev1.ConfigMap
+	backoff := wait.Backoff{Steps: s.opts.LoadRetries + 1, Duration: 100 * time.Millisecond, Factor: 2, Jitter: 0.1}
+	err := retry.OnError(backoff, isTransient, func() (err error) {
+		if live {
+			cm, err = s.objects.Get(ctx, s.name)
+		} else {
+			cm, err = s.getConfigMap(ctx)
+		}
+		if isTransient(err) {
+			log.WithError(err).Debugf("Transient error fetching ConfigMap %s/%s", s.namespace, s.name)
+		}
+		return err
+	})
+	var records []*endpoint.Endpoint
+	// Only fall back when there are no records at all; an empty list is what we write after deleting the last record
+	absent := false
+	if apierrors.IsNotFound(err) {
+		var known bool
+		records, known = s.handleMissing()
+		absent, err = !known, nil
+	} else if err == nil {
+		_, hasRecords := cm.Data[s.opts.RecordsKey]
+		if records, err = s.decodeRecords(cm); err == nil {
+			absent = !hasRecords && len(records) == 0
+			s.remember(records)
+		}
+	} else {
+		err = errors.Wrap(err, "Could not fetch configmap")
+	}
+	if err != nil || !absent || s.opts.FallbackName == "" {
+		return records, err
+	}
+
+	return s.loadFallback(ctx)
+}
+
+// Whether an error from the apiserver is likely to go away if the request is retried
+func isTransient(err error) bool {
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsUnexpectedServerError(err) ||
+		utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
+
+// Reads records from the fallback ConfigMap, used when the primary or its records key is missing
+func (s *Storage) loadFallback(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	log.Debugf("ConfigMap %s/%s has no records. Reading from fallback %s.", s.namespace, s.name, s.opts.FallbackName)
+	cm, err := s.objects.Get(ctx, s.opts.FallbackName)
 	if apierrors.IsNotFound(err) {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not fetch configmap")
+		return nil, errors.Wrap(err, "Could not fetch fallback configmap")
 	}
-	data, ok := cm.Data["records"]
+	return s.decodeRecords(cm)
+}
+
+func (s *Storage) decodeRecords(cm *corev1.ConfigMap) ([]*endpoint.Endpoint, error) {
+	data, ok := cm.Data[s.opts.RecordsKey]
 	if !ok {
-		return nil, errors.Wrap(err, "Malformed configmap (missing records key)")
+		// e.g. a ConfigMap which was pre-created with only a config key
+		if config, ok := cm.Data[s.opts.ConfigKey]; ok && s.opts.AdoptExisting {
+			records := parseHostsBlock(config)
+			log.Infof("ConfigMap %s/%s has no %s key. Adopting %d records from its hosts block.", cm.Namespace, cm.Name, s.opts.RecordsKey, len(records))
+			return records, nil
+		}
+		log.Warnf("ConfigMap %s/%s has no %s key. Treating it as empty.", cm.Namespace, cm.Name, s.opts.RecordsKey)
+		return []*endpoint.Endpoint{}, nil
 	}
 	var records []*endpoint.Endpoint
 	if err := json.Unmarshal([]byte(data), &records); err != nil {
 		return nil, errors.Wrap(err, "Unmarshalling records failed")
 	}
+	// Older versions could store a literal null, which we treat as empty
+	if records == nil {
+		records = []*endpoint.Endpoint{}
+	}
 
 	return records, nil
 }
 
-func (s Storage) emptyConfigMap() *corev1.ConfigMap {
-	return &corev1.ConfigMap{
+// Records the given records as the last known state of the ConfigMap
+func (s *Storage) remember(records []*endpoint.Endpoint) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.seen = true
+	s.state.missing = false
+	s.state.lastKnown = slices.Clone(records)
+	s.state.syncErr = nil
+	observeStoredRecords(s.namespace+"/"+s.name, records)
+}
+
+// Called when the ConfigMap doesn't exist, returning the records to treat it as holding and whether they're known
+// If we've seen it before, it was deleted out from under us, so optionally report the last known records.
+// Loading never writes; the ConfigMap is recreated with them by the next Modify, such as recreate's.
+func (s *Storage) handleMissing() ([]*endpoint.Endpoint, bool) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	if !s.state.seen {
+		return nil, false
+	}
+	if !s.opts.RecreateOnDelete {
+		// Only warn once per disappearance
+		s.state.seen = false
+		log.Warnf("ConfigMap %s/%s was deleted unexpectedly. Treating it as empty.", s.namespace, s.name)
+		return nil, false
+	}
+
+	if !s.state.missing {
+		s.state.missing = true
+		log.Warnf("ConfigMap %s/%s was deleted unexpectedly. Recreating it with %d known records.", s.namespace, s.name, len(s.state.lastKnown))
+	}
+	return slices.Clone(s.state.lastKnown), true
+}
+
+// Recreates the ConfigMap after it's deleted, saving the last known records via Modify
+func (s *Storage) recreate() {
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+
+	if err := s.Modify(ctx, func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return records, nil
+	}); err != nil {
+		log.WithError(err).Errorf("Could not recreate ConfigMap %s/%s", s.namespace, s.name)
+	}
+}
+
+// Serializes records for the records key, optionally annotating each with its zone
+func (s *Storage) marshalRecords(records []*endpoint.Endpoint) ([]byte, error) {
+	// Always write an empty list rather than null
+	if records == nil {
+		records = []*endpoint.Endpoint{}
+	}
+	if !s.opts.AnnotateZones {
+		return json.Marshal(records)
+	}
+
+	zoned := make([]zonedEndpoint, 0, len(records))
+	for _, ep := range records {
+		zoned = append(zoned, zonedEndpoint{ep, findZone(s.opts.Zones, ep.DNSName)})
+	}
+	return json.Marshal(zoned)
+}
+
+func (s *Storage) emptyConfigMap() *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      s.name,
 			Namespace: s.namespace,
 		},
-		Data: map[string]string{"records": "[]", "config": ""},
+		Data: map[string]string{s.opts.RecordsKey: "[]", s.opts.ConfigKey: ""},
 	}
+	if s.opts.AddFinalizer {
+		cm.Finalizers = []string{finalizerName}
+	}
+	s.applyMetadata(cm)
+	return cm
 }
 
-func (s Storage) Save(ctx context.Context, newRecords []*endpoint.Endpoint) error {
-	config, err := s.renderConfig(newRecords)
-	if err != nil {
-		return errors.Wrap(err, "Rendering config failed")
+// Creates an empty ConfigMap, owned by the configured owner if any
+// The owner reference is only set at creation, so that later manual edits to it are left alone
+func (s *Storage) createConfigMap(ctx context.Context) (*corev1.ConfigMap, error) {
+	cm := s.emptyConfigMap()
+	if s.opts.OwnerKind != "" {
+		owner, err := s.ownerReference(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cm.OwnerReferences = []metav1.OwnerReference{owner}
+	}
+	return s.objects.Create(ctx, cm)
+}
+
+// Ensures our configured labels and annotations are present, leaving any others untouched
+func (s *Storage) applyMetadata(cm *corev1.ConfigMap) {
+	if len(s.opts.Labels) > 0 && cm.Labels == nil {
+		cm.Labels = map[string]string{}
+	}
+	for k, v := range s.opts.Labels {
+		cm.Labels[k] = v
+	}
+	if len(s.opts.Annotations) > 0 && cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	for k, v := range s.opts.Annotations {
+		cm.Annotations[k] = v
+	}
+}
+
+// Save replaces the stored records, based on the cached ConfigMap
+// A conflict is returned as-is if another writer has updated it since; use Modify to retry against their update.
+func (s *Storage) Save(ctx context.Context, newRecords []*endpoint.Endpoint) error {
+	return s.store(ctx, newRecords, false)
+}
+
+// Replaces the stored records, bypassing the cache when live is set
+func (s *Storage) store(ctx context.Context, newRecords []*endpoint.Endpoint, live bool) error {
+	if !s.mayWrite() {
+		return errors.Errorf("Not the leader, so not writing ConfigMap %s/%s", s.namespace, s.name)
 	}
-	data, err := json.Marshal(newRecords)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// Names differing only in case or a trailing dot are the same, so must share a key
+	newRecords, err := dedupeRecords(canonicalizeRecords(newRecords), s.opts.DuplicateKeyStrategy)
 	if err != nil {
-		return errors.Wrap(err, "Marshalling records failed")
+		return errors.Wrap(err, "Merging duplicate records failed")
 	}
-	c, err := s.client()
+	saved, err := s.save(ctx, newRecords, live)
 	if err != nil {
-		return errors.Wrap(err, "Could not connect to kubernetes")
+		return err
+	}
+	// A dry run wrote nothing, so the ConfigMap mustn't be treated as holding the records, or as ever having existed
+	if !s.opts.DryRun {
+		s.remember(saved)
+	}
+	s.forgetSightings(saved)
+	s.state.Lock()
+	s.state.lastSave = s.clock()
+	s.state.Unlock()
+	return nil
+}
+
+// Writes the records and their rendered config to the ConfigMap, returning the records as stored
+func (s *Storage) save(ctx context.Context, newRecords []*endpoint.Endpoint, live bool) ([]*endpoint.Endpoint, error) {
+	var cm *corev1.ConfigMap
+	var err error
+	if live {
+		cm, err = s.objects.Get(ctx, s.name)
+	} else {
+		cm, err = s.getConfigMap(ctx)
 	}
-	cm, err := c.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
 	if apierrors.IsNotFound(err) {
-		cm, err = c.CoreV1().ConfigMaps(s.namespace).Create(ctx, s.emptyConfigMap(), metav1.CreateOptions{})
+		if s.opts.DryRun {
+			cm, err = s.emptyConfigMap(), nil
+		} else {
+			cm, err = s.createConfigMap(ctx)
+		}
 	}
 	if err != nil {
-		return errors.Wrap(err, "Could not fetch or create configmap")
+		return nil, errors.Wrap(err, "Could not fetch or create configmap")
 	}
-	cm.Data["records"] = string(data)
-	cm.Data["config"] = config
-	// TODO: Don't update if there have been no changes
-	if _, err := c.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
-		return errors.Wrap(err, "Could not update configmap")
+	// e.g. a ConfigMap which was pre-created without any data
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
 	}
-	return nil
+	original := cm.DeepCopy()
+	if s.opts.PruneAfter > 0 {
+		previous, lastSeen := decodePruneState(cm.Data, s.opts.RecordsKey)
+		var newLastSeen map[string]time.Time
+		newRecords, newLastSeen = pruneStale(newRecords, previous, lastSeen, s.sightings(), s.clock(), s.opts.PruneAfter)
+		lastSeenData, err := json.Marshal(newLastSeen)
+		if err != nil {
+			return nil, errors.Wrap(err, "Marshalling last-seen timestamps failed")
+		}
+		cm.Data["last-seen"] = string(lastSeenData)
+	}
+	var skipped skipList
+	configs, err := s.renderConfigs(ctx, newRecords, &skipped)
+	if err != nil {
+		return nil, errors.Wrap(err, "Rendering config failed")
+	}
+	s.rememberSkipped(skipped)
+	data, err := s.marshalRecords(newRecords)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshalling records failed")
+	}
+	cm.Data[s.opts.RecordsKey] = string(data)
+	if !s.opts.NoRender && s.opts.SkipEmptyConfig && allEmptyConfigs(configs) && !allEmptyConfigs(s.storedConfigs(cm.Data)) {
+		log.Warn("Rendered config contains no records. Keeping the previous config.")
+	} else {
+		// Drop the keys of the other output mode, along with those of record types no longer present
+		maps.DeleteFunc(cm.Data, func(key, _ string) bool {
+			return s.isConfigKey(key) || key == "config-sha256"
+		})
+		maps.Copy(cm.Data, configs)
+		if config, ok := configs[s.opts.ConfigKey]; ok {
+			cm.Data["config-sha256"] = configChecksum(config)
+		}
+		if len(configs) > 0 {
+			if cm.Annotations == nil {
+				cm.Annotations = map[string]string{}
+			}
+			cm.Annotations[configHashAnnotation] = s.configsChecksum(configs)
+		}
+	}
+	if s.opts.AddFinalizer && !slices.Contains(cm.Finalizers, finalizerName) {
+		cm.Finalizers = append(cm.Finalizers, finalizerName)
+	}
+	s.applyMetadata(cm)
+	if size := dataSize(cm.Data); size > maxObjectSize {
+		return nil, errors.Errorf("ConfigMap %s/%s would hold %d bytes of data (%d records), exceeding the %d byte limit on ConfigMaps and Secrets; reduce the records managed or use --no-render", s.namespace, s.name, size, len(newRecords), maxObjectSize)
+	}
+	if s.opts.DryRun {
+		keys := make([]string, 0, len(configs))
+		for key := range configs {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			log.Infof("Dry run: not writing %s to ConfigMap %s/%s:\n%s", key, s.namespace, s.name, configs[key])
+		}
+		return newRecords, nil
+	}
+	if equality.Semantic.DeepEqual(original, cm) {
+		log.Debugf("ConfigMap %s/%s is unchanged. Skipping update.", s.namespace, s.name)
+		return newRecords, nil
+	}
+	if cm.Immutable != nil && *cm.Immutable {
+		// The API server would reject the update with a generic "field is immutable" error
+		return nil, errors.Errorf("ConfigMap %s/%s is marked immutable, so its records can't be updated; recreate it without \"immutable: true\"", s.namespace, s.name)
+	}
+	updated, err := s.objects.Update(ctx, cm)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not update configmap")
+	}
+	s.cacheConfigMap(updated)
+	s.emitChangeEvent(original, updated)
+	if hash := updated.Annotations[configHashAnnotation]; hash != original.Annotations[configHashAnnotation] {
+		s.reloadDeployment(ctx, hash)
+	}
+	return newRecords, nil
+}
+
+// Renders the config into the ConfigMap keys it should be written to
+// Normally this is the single config key, but with SplitConfig each record type present gets its own key
+func (s *Storage) renderConfigs(ctx context.Context, records []*endpoint.Endpoint, skipped *skipList) (map[string]string, error) {
+	if s.opts.NoRender {
+		return map[string]string{}, nil
+	}
+	if !s.opts.SplitConfig {
+		config, err := s.renderer.render(ctx, records, skipped)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{s.opts.ConfigKey: config}, nil
+	}
+
+	byType := make(map[string][]*endpoint.Endpoint)
+	for _, ep := range records {
+		recordType := ep.RecordType
+		if recordType == "SPF" {
+			// Rendered as TXT, so it must share the TXT records' key
+			recordType = endpoint.RecordTypeTXT
+		}
+		byType[recordType] = append(byType[recordType], ep)
+	}
+
+	configs := make(map[string]string, len(byType))
+	for recordType, group := range byType {
+		config, err := s.renderer.render(ctx, group, skipped)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Rendering %s records failed", recordType)
+		}
+		// Types which couldn't be rendered at all don't get a key
+		if !isEmptyConfig(config) {
+			configs[splitConfigKey(recordType)] = config
+		}
+	}
+	return configs, nil
 }
 
-func (s Storage) renderConfig(records []*endpoint.Endpoint) (string, error) {
-	// TODO: Support per-record TTLs
-	// TODO: Support multiple IPs for standard records
-	// TODO: Support non-A records
+// Returns the ConfigMap key holding the config for a single record type, when using SplitConfig
+func splitConfigKey(recordType string) string {
+	return strings.ToLower(recordType) + "-records"
+}
 
-	// Sort the records, for readability
-	slices.SortFunc(records, func(a, b *endpoint.Endpoint) int {
-		return strings.Compare(a.DNSName, b.DNSName)
+// Whether a ConfigMap key holds rendered config, in either output mode
+// Only the keys we generate match, so that others' data is left alone.
+func (s *Storage) isConfigKey(key string) bool {
+	if key == s.opts.RecordsKey {
+		return false
+	}
+	return key == s.opts.ConfigKey || slices.ContainsFunc(supportedRecordTypes, func(recordType string) bool {
+		return key == splitConfigKey(recordType)
 	})
+}
 
-	// To simplify the template, split records into wildcard and standard
-	standard := make([]*endpoint.Endpoint, 0, len(records))
-	wildcard := make([]*endpoint.Endpoint, 0, len(records))
+// Returns the rendered config currently stored in the ConfigMap, by key
+func (s *Storage) storedConfigs(data map[string]string) map[string]string {
+	configs := maps.Clone(data)
+	maps.DeleteFunc(configs, func(key, _ string) bool {
+		return !s.isConfigKey(key)
+	})
+	return configs
+}
 
-	for _, ep := range records {
-		if ep.DNSName[0] != '*' {
-			if ep.RecordType != "A" {
-				log.Warnf("Record \"%s\" uses unsupported record type \"%s\". Skipping.", ep.DNSName, ep.RecordType)
-				continue
-			}
-			if ep.RecordTTL.IsConfigured() {
-				log.Warnf("Record \"%s\" uses unsupported custom TTL \"%d\". Defaulting to 60s.", ep.DNSName, ep.RecordTTL)
-			}
-			standard = append(standard, ep)
-		} else {
-			wildcard = append(wildcard, ep)
+// Whether none of the given configs contain any records
+func allEmptyConfigs(configs map[string]string) bool {
+	for _, config := range configs {
+		if !isEmptyConfig(config) {
+			return false
 		}
 	}
+	return true
+}
+
+// Approximates the size of a ConfigMap's data, as counted towards the apiserver's limit
+func dataSize(data map[string]string) int {
+	size := 0
+	for key, value := range data {
+		size += len(key) + len(value)
+	}
+	return size
+}
 
-	ctx := map[string][]*endpoint.Endpoint{
-		"standard": standard[:],
-		"wildcard": wildcard[:],
+// Whether a rendered config contains nothing but comments and whitespace
+func isEmptyConfig(config string) bool {
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
 	}
-	buf := bytes.Buffer{}
+	return true
+}
 
-	if err := s.configTemplate.Execute(&buf, ctx); err != nil {
-		return "", err
+// Returns the hex-encoded SHA-256 of the rendered config, letting consumers verify it hasn't been tampered with
+func configChecksum(config string) string {
+	sum := sha256.Sum256([]byte(config))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checksums all of the rendered config keys together; for a single config key this matches configChecksum
+func (s *Storage) configsChecksum(configs map[string]string) string {
+	if config, ok := configs[s.opts.ConfigKey]; ok && len(configs) == 1 {
+		return configChecksum(config)
+	}
+	keys := make([]string, 0, len(configs))
+	for key := range configs {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key + "\x00" + configs[key] + "\x00"))
 	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Close stops watching the ConfigMap on shutdown, and releases it by removing our finalizer if one was added
+func (s *Storage) Close(ctx context.Context) error {
+	s.state.modifying.Lock()
+	defer s.state.modifying.Unlock()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	s.stopInformer()
+	defer s.stopEvents()
+	// The leader is responsible for the finalizer, so other replicas mustn't remove it while it's running
+	if !s.opts.AddFinalizer || s.opts.DryRun || !s.mayWrite() {
+		return nil
+	}
+	cm, err := s.objects.Get(ctx, s.name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not fetch configmap")
+	}
+	if !slices.Contains(cm.Finalizers, finalizerName) {
+		return nil
+	}
+	cm.Finalizers = slices.DeleteFunc(cm.Finalizers, func(f string) bool {
+		return f == finalizerName
+	})
+	if _, err := s.objects.Update(ctx, cm); err != nil {
+		return errors.Wrap(err, "Could not remove finalizer from configmap")
+	}
+	return nil
+}
 
-	return buf.String(), nil
+// RenderedRecords returns the records as they would be rendered, omitting any which would be skipped
+func (s *Storage) RenderedRecords(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+	standard, wildcard, templated := s.renderer.partitionRecords(records, &skipList{})
+	return slices.Concat(standard, wildcard, templated)
 }
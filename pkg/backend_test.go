@@ -0,0 +1,681 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"os"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testName      = "dns"
+	testNamespace = "default"
+)
+
+// Creates a Storage backed by a fake clientset holding the given objects
+func newTestStorage(t *testing.T, opts StorageOptions, objects ...runtime.Object) (*Storage, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	return newTestStorageWithClient(t, client, opts), client
+}
+
+// Creates a Storage using the given clientset, e.g. one with reactors injecting errors
+func newTestStorageWithClient(t *testing.T, client *fake.Clientset, opts StorageOptions) *Storage {
+	t.Helper()
+	s := newStorage(testName, testNamespace, client, opts)
+	t.Cleanup(func() {
+		_ = s.Close(context.Background())
+	})
+	return s
+}
+
+// A ConfigMap in the test namespace holding the given data
+func testConfigMap(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Data:       data,
+	}
+}
+
+// Serializes records as they're stored in the records key
+func marshalTestRecords(t *testing.T, records ...*endpoint.Endpoint) string {
+	t.Helper()
+	if records == nil {
+		records = []*endpoint.Endpoint{}
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Fetches the named ConfigMap straight from the fake clientset
+func getTestConfigMap(t *testing.T, client *fake.Clientset, name string) *corev1.ConfigMap {
+	t.Helper()
+	cm, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+// Loads the stored records, failing the test on error
+func loadTestRecords(t *testing.T, s RecordStorage) []*endpoint.Endpoint {
+	t.Helper()
+	records, err := s.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// A clock which only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Applies fn to the stored records via Modify, failing the test on error
+func modifyTestRecords(t *testing.T, s RecordStorage, fn func([]*endpoint.Endpoint) []*endpoint.Endpoint) {
+	t.Helper()
+	err := s.Modify(context.Background(), func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return fn(records), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveKeepsForeignKeys(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{
+		"records":         marshalTestRecords(t),
+		"a-records":       "stale",
+		"mirror-records":  "someone else's",
+		"config":          "stale",
+		"Corefile.backup": "someone else's",
+	})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, SplitConfig: true}, existing)
+
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{endpoint.NewEndpoint("txt.example.com", endpoint.RecordTypeTXT, "hello")}
+	})
+
+	data := getTestConfigMap(t, client, testName).Data
+	for _, key := range []string{"a-records", "config"} {
+		if _, ok := data[key]; ok {
+			t.Errorf("stale config key %s was kept", key)
+		}
+	}
+	for _, key := range []string{"mirror-records", "Corefile.backup"} {
+		if data[key] != "someone else's" {
+			t.Errorf("foreign key %s was changed to %q", key, data[key])
+		}
+	}
+	if !strings.Contains(data["txt-records"], "txt.example.com") {
+		t.Errorf("txt-records doesn't hold the TXT record: %q", data["txt-records"])
+	}
+}
+
+// Polls until cond holds, failing the test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeletedConfigMap(t *testing.T) {
+	record := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	tests := []struct {
+		name      string
+		recreate  bool
+		wantNames []string
+	}{
+		{"treated as empty", false, nil},
+		{"recreated", true, []string{"a.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, RecreateOnDelete: tt.recreate})
+			modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{record}
+			})
+
+			err := client.CoreV1().ConfigMaps(testNamespace).Delete(context.Background(), testName, metav1.DeleteOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.recreate {
+				waitFor(t, "the ConfigMap to be recreated", func() bool {
+					cm, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), testName, metav1.GetOptions{})
+					return err == nil && strings.Contains(cm.Data["records"], record.DNSName)
+				})
+			} else {
+				waitFor(t, "the cache to see the deletion", func() bool {
+					records, err := s.Load(context.Background())
+					return err == nil && len(records) == 0
+				})
+				if _, err := client.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), testName, metav1.GetOptions{}); err == nil {
+					t.Error("Load recreated the ConfigMap")
+				}
+			}
+			if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, tt.wantNames) {
+				t.Errorf("loaded %v, want %v", got, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestFinalizerIsRemovedOnClose(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// Not newTestStorage, as we close it ourselves
+	s := newStorage(testName, testNamespace, client, StorageOptions{DefaultTTL: 300, AddFinalizer: true})
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")}
+	})
+	if finalizers := getTestConfigMap(t, client, testName).Finalizers; !slices.Contains(finalizers, finalizerName) {
+		t.Fatalf("created ConfigMap has finalizers %v, want %s", finalizers, finalizerName)
+	}
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if finalizers := getTestConfigMap(t, client, testName).Finalizers; slices.Contains(finalizers, finalizerName) {
+		t.Errorf("finalizer wasn't removed on close: %v", finalizers)
+	}
+}
+
+func TestConfigChecksum(t *testing.T) {
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")}
+	})
+
+	data := getTestConfigMap(t, client, testName).Data
+	sum := sha256.Sum256([]byte(data["config"]))
+	if want := hex.EncodeToString(sum[:]); data["config-sha256"] != want {
+		t.Errorf("config-sha256 is %q, want %q", data["config-sha256"], want)
+	}
+}
+
+func TestSkipEmptyConfigKeepsPreviousConfig(t *testing.T) {
+	previous := "hosts {\n\t10.0.0.1 a.example.com\n}\n"
+	tests := []struct {
+		name string
+		skip bool
+		kept bool
+	}{
+		{"overwritten by default", false, false},
+		{"kept when skipping", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := testConfigMap(testName, map[string]string{
+				"records": marshalTestRecords(t, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")),
+				"config":  previous,
+			})
+			s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, SkipEmptyConfig: tt.skip}, existing)
+
+			// Neither record can be rendered
+			modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+				return []*endpoint.Endpoint{
+					endpoint.NewEndpoint("bogus.example.com", endpoint.RecordTypeA, "not-an-ip"),
+					endpoint.NewEndpoint("", endpoint.RecordTypeA, "10.0.0.2"),
+				}
+			})
+
+			data := getTestConfigMap(t, client, testName).Data
+			if kept := data["config"] == previous; kept != tt.kept {
+				t.Errorf("got config %q, want previous kept: %v", data["config"], tt.kept)
+			}
+			if strings.Contains(data["records"], "a.example.com") {
+				t.Error("records weren't updated")
+			}
+		})
+	}
+}
+
+func TestFallbackConfigMap(t *testing.T) {
+	fallback := testConfigMap("fallback", map[string]string{
+		"records": marshalTestRecords(t, endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "10.0.0.1")),
+	})
+	tests := []struct {
+		name    string
+		primary *corev1.ConfigMap
+		want    []string
+	}{
+		{"primary missing", nil, []string{"old.example.com"}},
+		{"records key missing", testConfigMap(testName, map[string]string{"config": ""}), []string{"old.example.com"}},
+		{"no records left", testConfigMap(testName, map[string]string{"records": "[]"}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{fallback.DeepCopy()}
+			if tt.primary != nil {
+				objects = append(objects, tt.primary)
+			}
+			s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, FallbackName: "fallback"}, objects...)
+			if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, tt.want) {
+				t.Errorf("loaded %v, want %v", got, tt.want)
+			}
+
+			// Saves always go to the primary
+			modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+				return append(records, endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "10.0.0.2"))
+			})
+			if !strings.Contains(getTestConfigMap(t, client, testName).Data["records"], "new.example.com") {
+				t.Error("the primary wasn't saved")
+			}
+			if getTestConfigMap(t, client, "fallback").Data["records"] != fallback.Data["records"] {
+				t.Error("the fallback was modified")
+			}
+		})
+	}
+}
+
+func TestNoRender(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t), "config": "stale"})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, NoRender: true}, existing)
+
+	warnings := captureWarnings(func() {
+		modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+			return []*endpoint.Endpoint{
+				endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+				endpoint.NewEndpoint("ptr.example.com", endpoint.RecordTypePTR, "a.example.com"),
+			}
+		})
+	})
+
+	data := getTestConfigMap(t, client, testName).Data
+	if config, ok := data["config"]; ok {
+		t.Errorf("config key is still present: %q", config)
+	}
+	if !strings.Contains(data["records"], "ptr.example.com") {
+		t.Errorf("records weren't stored: %q", data["records"])
+	}
+	if len(warnings) > 0 {
+		t.Errorf("got render warnings %q", warnings)
+	}
+}
+
+func TestModifyRetriesConflicts(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t)})
+	client := fake.NewSimpleClientset(existing)
+	conflicts := 1
+	client.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), testName, stderrors.New("object was modified"))
+		}
+		return false, nil, nil
+	})
+	s := newTestStorageWithClient(t, client, StorageOptions{DefaultTTL: 300})
+
+	calls := 0
+	err := s.Modify(context.Background(), func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		calls++
+		return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")), nil
+	})
+	if err != nil {
+		t.Fatalf("Modify failed despite retrying: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want once per attempt", calls)
+	}
+	if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, []string{"a.example.com"}) {
+		t.Errorf("stored %v, want the record added once", got)
+	}
+}
+
+func TestConfigMapWithoutData(t *testing.T) {
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, testConfigMap(testName, nil))
+	if records := loadTestRecords(t, s); len(records) != 0 {
+		t.Errorf("loaded %v from an empty ConfigMap", recordNames(records))
+	}
+
+	modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+		return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"))
+	})
+	data := getTestConfigMap(t, client, testName).Data
+	if !strings.Contains(data["records"], "a.example.com") || !strings.Contains(data["config"], "10.0.0.1 a.example.com") {
+		t.Errorf("records weren't saved: %v", data)
+	}
+}
+
+func TestSaveDeduplicatesRecords(t *testing.T) {
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+	for range 2 {
+		modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+			return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"))
+		})
+	}
+
+	if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, []string{"a.example.com"}) {
+		t.Errorf("stored %v, want a single copy", got)
+	}
+	if config := getTestConfigMap(t, client, testName).Data["config"]; strings.Count(config, "10.0.0.1 a.example.com") != 1 {
+		t.Errorf("config doesn't have exactly one hosts line:\n%s", config)
+	}
+}
+
+func TestSaveRejectsOversizedConfigMaps(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t)})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+
+	records := make([]*endpoint.Endpoint, 0, 20000)
+	for i := range cap(records) {
+		records = append(records, endpoint.NewEndpoint(fmt.Sprintf("host-%05d.example.com", i), endpoint.RecordTypeA, fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff)))
+	}
+	err := s.Modify(context.Background(), func([]*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return records, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "exceeding the 1048576 byte limit") {
+		t.Errorf("got error %v, want one naming the size limit", err)
+	}
+	if data := getTestConfigMap(t, client, testName).Data; data["records"] != existing.Data["records"] {
+		t.Error("the oversized records were written")
+	}
+}
+
+func TestLoadRetriesTransientErrors(t *testing.T) {
+	record := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		wantGets  int
+		wantError bool
+	}{
+		{"recovers from transient errors", apierrors.NewServiceUnavailable("apiserver is restarting"), 2, 3, false},
+		{"gives up after the retry budget", apierrors.NewServiceUnavailable("apiserver is down"), 10, 4, true},
+		{"doesn't retry other errors", apierrors.NewForbidden(corev1.Resource("configmaps"), testName, stderrors.New("access denied")), 10, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(testConfigMap(testName, map[string]string{"records": marshalTestRecords(t, record)}))
+			s := newTestStorageWithClient(t, client, StorageOptions{DefaultTTL: 300, LoadRetries: 3})
+
+			gets, failures := 0, tt.failures
+			client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+				gets++
+				if failures > 0 {
+					failures--
+					return true, nil, tt.err
+				}
+				return false, nil, nil
+			})
+
+			records, err := s.load(context.Background(), true)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if gets != tt.wantGets {
+				t.Errorf("fetched the ConfigMap %d times, want %d", gets, tt.wantGets)
+			}
+			if !tt.wantError && !slices.Equal(recordNames(records), []string{record.DNSName}) {
+				t.Errorf("loaded %v, want the stored record", recordNames(records))
+			}
+		})
+	}
+}
+
+func TestCanonicalizeOnStartSkipsUnchangedConfigMaps(t *testing.T) {
+	opts := StorageOptions{DefaultTTL: 300, CanonicalizeOnStart: true}
+	first, client := newTestStorage(t, opts)
+	modifyTestRecords(t, first, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")}
+	})
+
+	// A restart finds the ConfigMap already in canonical form
+	client.ClearActions()
+	newTestStorageWithClient(t, client, opts)
+	if writes := countWrites(client); writes != 0 {
+		t.Errorf("got %d writes canonicalizing a canonical ConfigMap, want none", writes)
+	}
+
+	// But does rewrite one which isn't
+	cm := getTestConfigMap(t, client, testName)
+	cm.Data["config"] = "edited by hand"
+	if _, err := client.CoreV1().ConfigMaps(testNamespace).Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	client.ClearActions()
+	newTestStorageWithClient(t, client, opts)
+	if writes := countWrites(client); writes != 1 {
+		t.Errorf("got %d writes canonicalizing an edited ConfigMap, want one", writes)
+	}
+}
+
+func TestCustomDataKeys(t *testing.T) {
+	opts := StorageOptions{DefaultTTL: 300, ConfigKey: "Corefile.records", RecordsKey: "external-dns.json"}
+	s, client := newTestStorage(t, opts, testConfigMap(testName, map[string]string{"Corefile": "someone else's"}))
+	if records := loadTestRecords(t, s); len(records) != 0 {
+		t.Errorf("loaded %v without a records key", recordNames(records))
+	}
+
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")}
+	})
+	data := getTestConfigMap(t, client, testName).Data
+	if !strings.Contains(data["external-dns.json"], "a.example.com") || !strings.Contains(data["Corefile.records"], "10.0.0.1 a.example.com") {
+		t.Errorf("records and config weren't written under the custom keys: %v", data)
+	}
+	for _, key := range []string{"records", "config"} {
+		if _, ok := data[key]; ok {
+			t.Errorf("default key %s was written", key)
+		}
+	}
+	if data["Corefile"] != "someone else's" {
+		t.Errorf("foreign key was changed to %q", data["Corefile"])
+	}
+
+	// A restart reads them back
+	restarted := newTestStorageWithClient(t, client, opts)
+	if got := recordNames(loadTestRecords(t, restarted)); !slices.Equal(got, []string{"a.example.com"}) {
+		t.Errorf("loaded %v after restarting, want the saved record", got)
+	}
+}
+
+func TestImmutableConfigMap(t *testing.T) {
+	existing := testConfigMap(testName, nil)
+	immutable := true
+	existing.Immutable = &immutable
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+
+	err := s.Modify(context.Background(), func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")), nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Fatalf("got error %v, want one mentioning immutability", err)
+	}
+	if cm := getTestConfigMap(t, client, testName); len(cm.Data) != 0 {
+		t.Errorf("immutable ConfigMap was written: %v", cm.Data)
+	}
+}
+
+func TestDryRunMakesNoMutations(t *testing.T) {
+	record := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+	}{
+		{"missing ConfigMap", nil},
+		{"existing ConfigMap", []runtime.Object{testConfigMap(testName, map[string]string{"records": marshalTestRecords(t)})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, DryRun: true, RecreateOnDelete: true}, tt.objects...)
+			client.ClearActions()
+
+			var records []*endpoint.Endpoint
+			warnings := captureWarnings(func() {
+				modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+					return append(records, record)
+				})
+				records = loadTestRecords(t, s)
+			})
+			for _, action := range client.Actions() {
+				if verb := action.GetVerb(); verb == "create" || verb == "update" || verb == "patch" || verb == "delete" {
+					t.Errorf("dry run made a %s of %s", verb, action.GetResource().Resource)
+				}
+			}
+			if len(records) != 0 {
+				t.Errorf("loaded %v, which were never written", recordNames(records))
+			}
+			if len(warnings) != 0 {
+				t.Errorf("got warnings %v, want none", warnings)
+			}
+		})
+	}
+}
+
+func TestSaveEmptyWritesEmptyList(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t,
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+	)})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return nil
+	})
+	if got := getTestConfigMap(t, client, testName).Data["records"]; got != "[]" {
+		t.Errorf("stored records %q, want []", got)
+	}
+}
+
+func TestLoadStoredNullIsEmpty(t *testing.T) {
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300}, testConfigMap(testName, map[string]string{"records": "null"}))
+	records := loadTestRecords(t, s)
+	if records == nil || len(records) != 0 {
+		t.Errorf("loaded %#v, want an empty list", records)
+	}
+}
+
+func TestMetadataKeptBySave(t *testing.T) {
+	labels := map[string]string{"app": "coredns"}
+	annotations := map[string]string{"example.com/owner": "dns-team"}
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, Labels: labels, Annotations: annotations})
+	modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+		return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"))
+	})
+	created := getTestConfigMap(t, client, testName)
+	if created.Labels["app"] != "coredns" || created.Annotations["example.com/owner"] != "dns-team" {
+		t.Fatalf("created ConfigMap has labels %v and annotations %v", created.Labels, created.Annotations)
+	}
+
+	// Someone else labels the ConfigMap too; a later save keeps both theirs and ours
+	created.Labels["team"] = "platform"
+	if _, err := client.CoreV1().ConfigMaps(testNamespace).Update(context.Background(), created, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the label to be cached", func() bool {
+		cm, err := s.getConfigMap(context.Background())
+		return err == nil && cm.Labels["team"] == "platform"
+	})
+	modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+		return append(records, endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2"))
+	})
+	saved := getTestConfigMap(t, client, testName)
+	if saved.Labels["app"] != "coredns" || saved.Labels["team"] != "platform" {
+		t.Errorf("saved ConfigMap has labels %v, want ours and theirs", saved.Labels)
+	}
+	if saved.Annotations["example.com/owner"] != "dns-team" {
+		t.Errorf("saved ConfigMap has annotations %v, want ours kept", saved.Annotations)
+	}
+}
+
+func TestLabelsPresentOnCreate(t *testing.T) {
+	labels := map[string]string{"app": "coredns"}
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, Labels: labels})
+	client.ClearActions()
+	modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+		return append(records, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"))
+	})
+
+	// The labels must be on the object as created, not only added by a later update
+	var created *corev1.ConfigMap
+	for _, action := range client.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok && action.GetResource().Resource == "configmaps" {
+			created = create.GetObject().(*corev1.ConfigMap)
+		}
+	}
+	if created == nil {
+		t.Fatal("ConfigMap wasn't created")
+	}
+	if created.Labels["app"] != "coredns" {
+		t.Errorf("ConfigMap was created with labels %v, want %v", created.Labels, labels)
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test
+`
+
+func TestKubeconfigWait(t *testing.T) {
+	path := t.TempDir() + "/kubeconfig"
+	go func() {
+		// Written then renamed into place, as a mounted file would appear all at once
+		time.Sleep(200 * time.Millisecond)
+		_ = os.WriteFile(path+".tmp", []byte(testKubeconfig), 0o600)
+		_ = os.Rename(path+".tmp", path)
+	}()
+	if _, err := NewClientset(path, "", 5*time.Second); err != nil {
+		t.Fatalf("waiting for a kubeconfig written after a delay failed: %v", err)
+	}
+}
+
+func TestKubeconfigWaitTimesOut(t *testing.T) {
+	path := t.TempDir() + "/kubeconfig"
+	start := time.Now()
+	_, err := NewClientset(path, "", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "did not appear") {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("gave up after %v, want about a second", elapsed)
+	}
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"sync"
+)
+
+// Caches our ConfigMap via an informer, so that reads don't need a roundtrip to the apiserver
+type configMapCache struct {
+	store cache.Store
+	stop  chan struct{}
+	// The ConfigMap as we last wrote it, which a late watch event could otherwise roll the store back past
+	written *corev1.ConfigMap
+	sync.Mutex
+}
+
+// Starts an informer watching only our ConfigMap
+func (s *Storage) startInformer() {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.clientset, 0,
+		informers.WithNamespace(s.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.name).String()
+		}),
+	)
+	informer := s.objects.informer(factory)
+	s.cache = configMapCache{
+		store: informer.GetStore(),
+		stop:  make(chan struct{}),
+	}
+	if s.opts.RecreateOnDelete {
+		_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			DeleteFunc: func(any) { go s.recreate() },
+		})
+	}
+	factory.Start(s.cache.stop)
+}
+
+// Stops the informer started by startInformer
+func (s *Storage) stopInformer() {
+	close(s.cache.stop)
+}
+
+// Fetches our ConfigMap from the cache, falling back to the apiserver on a miss (e.g. before the initial list)
+// The result may be freely modified
+func (s *Storage) getConfigMap(ctx context.Context) (*corev1.ConfigMap, error) {
+	if obj, exists, err := s.cache.store.GetByKey(s.namespace + "/" + s.name); err == nil && exists {
+		if cm, ok := s.objects.fromObject(obj); ok {
+			return s.cache.newest(cm), nil
+		}
+	}
+	return s.objects.Get(ctx, s.name)
+}
+
+// Stores a ConfigMap we've just written, so that the next read reflects it without waiting for the watch event
+func (s *Storage) cacheConfigMap(cm *corev1.ConfigMap) {
+	s.cache.Lock()
+	s.cache.written = cm.DeepCopy()
+	s.cache.Unlock()
+	_ = s.cache.store.Update(s.objects.toObject(cm))
+}
+
+// Returns the cached ConfigMap, or the one we last wrote if the cache has since been rolled back to an older version
+func (c *configMapCache) newest(cm *corev1.ConfigMap) *corev1.ConfigMap {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.written != nil && c.written.UID == cm.UID && olderVersion(cm.ResourceVersion, c.written.ResourceVersion) {
+		log.Debugf("Cached ConfigMap %s/%s is older than our last write. Ignoring it.", cm.Namespace, cm.Name)
+		return c.written.DeepCopy()
+	}
+	return cm
+}
+
+// Whether resource version a precedes b
+// Resource versions are formally opaque, so any which aren't integers are never considered older.
+func olderVersion(a, b string) bool {
+	av, aErr := strconv.ParseUint(a, 10, 64)
+	bv, bErr := strconv.ParseUint(b, 10, 64)
+	return aErr == nil && bErr == nil && av < bv
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+)
+
+func TestCacheIgnoresOlderVersions(t *testing.T) {
+	version := func(uid, resourceVersion, records string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: testName, Namespace: testNamespace, UID: types.UID(uid), ResourceVersion: resourceVersion},
+			Data:       map[string]string{"records": records},
+		}
+	}
+	var c configMapCache
+	c.written = version("a", "10", "written")
+
+	tests := []struct {
+		name   string
+		cached *corev1.ConfigMap
+		want   string
+	}{
+		{"older", version("a", "9", "cached"), "written"},
+		{"same", version("a", "10", "cached"), "cached"},
+		{"newer", version("a", "11", "cached"), "cached"},
+		{"recreated", version("b", "5", "cached"), "cached"},
+		{"opaque version", version("a", "v9", "cached"), "cached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.newest(tt.cached).Data["records"]; got != tt.want {
+				t.Errorf("got the %s ConfigMap, want the %s one", got, tt.want)
+			}
+		})
+	}
+}
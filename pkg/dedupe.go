@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"fmt"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+)
+
+// How to merge records which share a DNSName, RecordType and SetIdentifier
+type DuplicateKeyStrategy string
+
+const (
+	// Keep every record as-is
+	DuplicateKeyKeep DuplicateKeyStrategy = "keep"
+	// Merge the targets of all duplicates into the first
+	DuplicateKeyUnion DuplicateKeyStrategy = "union"
+	// Keep only the most recently added duplicate
+	DuplicateKeyLast DuplicateKeyStrategy = "last"
+	// Refuse to store duplicates at all
+	DuplicateKeyReject DuplicateKeyStrategy = "reject"
+)
+
+// DuplicateKeyStrategies lists the strategies which can be selected
+var DuplicateKeyStrategies = []DuplicateKeyStrategy{DuplicateKeyKeep, DuplicateKeyUnion, DuplicateKeyLast, DuplicateKeyReject}
+
+// Merges records with duplicate keys according to the strategy, defaulting to keeping the last
+// Each key keeps the position of its first occurrence, so the output order remains deterministic
+func dedupeRecords(records []*endpoint.Endpoint, strategy DuplicateKeyStrategy) ([]*endpoint.Endpoint, error) {
+	if strategy == "" {
+		strategy = DuplicateKeyLast
+	}
+	if strategy == DuplicateKeyKeep {
+		return records, nil
+	}
+
+	deduped := make([]*endpoint.Endpoint, 0, len(records))
+	positions := make(map[string]int, len(records))
+	for _, ep := range records {
+		key := recordKey(ep)
+		pos, seen := positions[key]
+		if !seen {
+			positions[key] = len(deduped)
+			deduped = append(deduped, ep)
+			continue
+		}
+
+		switch strategy {
+		case DuplicateKeyReject:
+			return nil, fmt.Errorf("duplicate record \"%s\" (%s, set identifier \"%s\")", ep.DNSName, ep.RecordType, ep.SetIdentifier)
+		case DuplicateKeyLast:
+			recordLog(ep).Debugf("Replacing duplicate record \"%s\" (%s)", ep.DNSName, ep.RecordType)
+			deduped[pos] = ep
+		case DuplicateKeyUnion:
+			recordLog(ep).Debugf("Merging targets of duplicate record \"%s\" (%s)", ep.DNSName, ep.RecordType)
+			merged := deduped[pos].DeepCopy()
+			for _, target := range ep.Targets {
+				if !slices.Contains(merged.Targets, target) {
+					merged.Targets = append(merged.Targets, target)
+				}
+			}
+			deduped[pos] = merged
+		}
+	}
+
+	return deduped, nil
+}
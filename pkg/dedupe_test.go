@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"testing"
+)
+
+func TestDedupeRecords(t *testing.T) {
+	records := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1", "10.0.0.2"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.1.1"),
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.2", "10.0.0.3"),
+	}
+	tests := []struct {
+		strategy DuplicateKeyStrategy
+		want     []endpoint.Targets
+		wantErr  bool
+	}{
+		{DuplicateKeyKeep, []endpoint.Targets{{"10.0.0.1", "10.0.0.2"}, {"10.0.1.1"}, {"10.0.0.2", "10.0.0.3"}}, false},
+		{DuplicateKeyUnion, []endpoint.Targets{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, {"10.0.1.1"}}, false},
+		{DuplicateKeyLast, []endpoint.Targets{{"10.0.0.2", "10.0.0.3"}, {"10.0.1.1"}}, false},
+		{"", []endpoint.Targets{{"10.0.0.2", "10.0.0.3"}, {"10.0.1.1"}}, false},
+		{DuplicateKeyReject, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			deduped, err := dedupeRecords(records, tt.strategy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			var got []endpoint.Targets
+			for _, ep := range deduped {
+				got = append(got, ep.Targets)
+			}
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("got targets %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !slices.Equal(records[0].Targets, endpoint.Targets{"10.0.0.1", "10.0.0.2"}) {
+		t.Error("union modified the original record")
+	}
+}
+
+func TestDedupeLogsRecordFields(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	_, err := dedupeRecords([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+	}, DuplicateKeyUnion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("merging duplicates logged nothing")
+	}
+	if entry.Data["dnsName"] != "a.example.com" || entry.Data["recordType"] != endpoint.RecordTypeA {
+		t.Errorf("got log fields %v, want the record's name and type", entry.Data)
+	}
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Reason given for the events emitted when the stored records change
+const eventReasonRecordsChanged = "RecordsChanged"
+
+// Starts recording events against the ConfigMap, if enabled
+func (s *Storage) startEvents() {
+	if !s.opts.EmitEvents {
+		return
+	}
+	s.broadcaster = record.NewBroadcaster()
+	s.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: s.clientset.CoreV1().Events(s.namespace)})
+	s.recorder = s.broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "external-dns-configmap-provider"})
+}
+
+// Flushes and stops the event recorder started by startEvents
+func (s *Storage) stopEvents() {
+	if s.broadcaster != nil {
+		s.broadcaster.Shutdown()
+	}
+}
+
+// Emits an event summarizing how the stored records changed between two versions of the ConfigMap
+func (s *Storage) emitChangeEvent(before, after *corev1.ConfigMap) {
+	if s.recorder == nil {
+		return
+	}
+	var previous, current []*endpoint.Endpoint
+	_ = json.Unmarshal([]byte(before.Data[s.opts.RecordsKey]), &previous)
+	_ = json.Unmarshal([]byte(after.Data[s.opts.RecordsKey]), &current)
+
+	added, removed, changed := diffRecords(previous, current)
+	if added+removed+changed == 0 {
+		return
+	}
+	s.recorder.Eventf(s.objects.toObject(after), corev1.EventTypeNormal, eventReasonRecordsChanged,
+		"Records changed: %d added, %d removed, %d changed", added, removed, changed)
+}
+
+// Counts the records added, removed and changed between two record sets, matching them by key
+func diffRecords(previous, current []*endpoint.Endpoint) (added, removed, changed int) {
+	previousByKey := make(map[string]*endpoint.Endpoint, len(previous))
+	for _, ep := range previous {
+		previousByKey[recordKey(ep)] = ep
+	}
+	for _, ep := range current {
+		key := recordKey(ep)
+		if prev, ok := previousByKey[key]; !ok {
+			added++
+		} else if !reflect.DeepEqual(prev, ep) {
+			changed++
+		}
+		delete(previousByKey, key)
+	}
+	return added, len(previousByKey), changed
+}
@@ -1,80 +1,423 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"runtime/debug"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 	"sigs.k8s.io/external-dns/provider/webhook/api"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ProviderOptions controls the behaviour of the webhook frontend
+type ProviderOptions struct {
+	// AllowWildcards permits wildcard records to be stored
+	AllowWildcards bool
+	// StrictJSON rejects request bodies containing unknown fields
+	StrictJSON bool
+	// VerbosePanics includes the panic's message in the 500 returned when a handler panics, rather than a generic one
+	VerbosePanics bool
+	// AuthToken, if set, must be presented as a bearer token on mutating requests
+	// external-dns's webhook client sends no Authorization header, so this needs a proxy in front which adds it.
+	AuthToken string
+	// RecordTypes are the record types which will be accepted (default: all that the storage supports)
+	RecordTypes []string
+	// RequireAPIVersion rejects mutating requests whose Accept header excludes the webhook API version,
+	// or whose Content-Type isn't the webhook API version
+	RequireAPIVersion bool
+	// Leader, if set, restricts changes to the replica holding the leader election Lease; others return 503
+	Leader *LeaderElection
+	// MaxRequestSize is the largest body accepted by mutating requests, in bytes; larger ones get a 413 (default: unlimited)
+	MaxRequestSize int64
+	// TrustedProxies are the CIDRs whose forwarding headers are believed when determining client IPs (default: none)
+	TrustedProxies []string
+}
+
+// Describes what the provider supports, as returned by GET /capabilities
+type capabilities struct {
+	RecordTypes    []string        `json:"recordTypes"`
+	AllowWildcards bool            `json:"allowWildcards"`
+	OutputFormat   string          `json:"outputFormat"`
+	Features       map[string]bool `json:"features"`
+}
+
+// RecordStorage is where the provider keeps its records; either a Storage or a ShardedStorage
+type RecordStorage interface {
+	Load(ctx context.Context) ([]*endpoint.Endpoint, error)
+	Modify(ctx context.Context, fn func([]*endpoint.Endpoint) ([]*endpoint.Endpoint, error)) error
+	SupportedRecordTypes() []string
+	Features() map[string]bool
+	Ready() error
+	Status() StorageStatus
+	Skipped() []SkippedRecord
+	MarkSeen(records []*endpoint.Endpoint)
+	RenderedRecords(records []*endpoint.Endpoint) []*endpoint.Endpoint
+	Close(ctx context.Context) error
+	unknownTypePolicy() UnknownTypePolicy
+}
+
 type Provider struct {
-	domainFilter   endpoint.DomainFilter
-	storage        Storage
-	allowWildcards bool
+	domainFilter endpoint.DomainFilter
+	storage      RecordStorage
+	opts         ProviderOptions
 	*gin.Engine
 }
 
-func NewProvider(domainFilter endpoint.DomainFilter, storage Storage, allowWildcards bool) *Provider {
+func NewProvider(domainFilter endpoint.DomainFilter, storage RecordStorage, opts ProviderOptions) *Provider {
+	if len(opts.RecordTypes) == 0 {
+		opts.RecordTypes = storage.SupportedRecordTypes()
+	}
 	p := &Provider{
 		domainFilter,
 		storage,
-		allowWildcards,
-		gin.Default(),
+		opts,
+		gin.New(),
+	}
+	if err := p.SetTrustedProxies(opts.TrustedProxies); err != nil {
+		log.WithError(err).Fatal("Invalid trusted proxies")
 	}
+	p.configureMiddleware()
 	p.configureRoutes()
 
 	return p
 }
 
+func (p *Provider) configureMiddleware() {
+	p.Use(logRequest)
+	p.Use(gin.CustomRecoveryWithWriter(nil, p.handlePanic))
+}
+
+// Logs each request via logrus, rather than gin's own logger, so that they share a format and level
+func logRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	log.WithFields(log.Fields{
+		"status":   c.Writer.Status(),
+		"method":   c.Request.Method,
+		"path":     c.Request.URL.Path,
+		"client":   c.ClientIP(),
+		"duration": time.Since(start),
+	}).Debug("Handled request")
+}
+
+// Logs a recovered panic, along with the request body which triggered it, and fails the request with a 500
+// The panic's message is only returned to the client with VerbosePanics.
+func (p *Provider) handlePanic(c *gin.Context, recovered any) {
+	log.WithField("panic", recovered).Errorf("Recovered from panic while handling %s %s", c.Request.Method, c.Request.URL.Path)
+	log.Debugf("Panic stack trace: %s", debug.Stack())
+	if body, ok := c.Get(gin.BodyBytesKey); ok {
+		log.Debugf("Panicking request body: %s", body)
+	}
+
+	message := "internal server error"
+	if p.opts.VerbosePanics {
+		message = fmt.Sprintf("%s: %v", message, recovered)
+	}
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
 func (p *Provider) configureRoutes() {
 	p.GET("/healthz", p.getHealth)
+	p.GET("/readyz", p.getReady)
 	p.GET("/", p.getDomainFilter)
+	p.GET("/capabilities", p.getCapabilities)
 	p.GET("/records", p.getRecords)
-	p.POST("/records", p.changeRecords)
-	p.POST("/adjustendpoints", p.takeAdjust)
+	p.GET("/status", p.getStatus)
+	p.GET("/skipped", p.getSkipped)
+	p.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	mutating := p.Group("/")
+	if p.opts.MaxRequestSize > 0 {
+		mutating.Use(p.limitRequestSize)
+	}
+	if p.opts.AuthToken != "" {
+		mutating.Use(p.requireToken)
+	}
+	if p.opts.RequireAPIVersion {
+		mutating.Use(requireAPIVersion, requireContentType)
+	}
+	// Only changes need the Lease; any replica can adjust endpoints
+	if p.opts.Leader != nil {
+		mutating.POST("/records", p.requireLeader, p.changeRecords)
+	} else {
+		mutating.POST("/records", p.changeRecords)
+	}
+	mutating.POST("/adjustendpoints", p.takeAdjust)
+}
+
+// Rejects requests which don't present the configured bearer token, with a 401
+func (p *Provider) requireToken(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(p.opts.AuthToken)) == 1 {
+		return
+	}
+	c.Header("WWW-Authenticate", "Bearer")
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+}
+
+// Rejects changes with a 503 unless we hold the leader election Lease, so that only one replica writes
+func (p *Provider) requireLeader(c *gin.Context) {
+	if p.opts.Leader.IsLeader() {
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "not the leader"})
+}
+
+// Caps the size of the request body, so that a huge payload can't exhaust memory before it's decoded
+func (p *Provider) limitRequestSize(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, p.opts.MaxRequestSize)
+}
+
+// Rejects requests whose body isn't in the webhook API version's format, with a 415
+// external-dns always sends its Content-Type, so unlike Accept, a missing one is rejected too
+func requireContentType(c *gin.Context) {
+	contentType := strings.ReplaceAll(c.GetHeader(api.ContentTypeHeader), " ", "")
+	if contentType == api.MediaTypeFormatAndVersion {
+		return
+	}
+	c.Header(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
+	c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "this webhook only accepts " + api.MediaTypeFormatAndVersion})
+}
+
+// Rejects requests which explicitly don't accept the webhook API version, with a 406
+// A missing Accept header accepts anything, matching external-dns, which only sends one on some requests
+func requireAPIVersion(c *gin.Context) {
+	accept := c.GetHeader("Accept")
+	if accept == "" {
+		return
+	}
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType = strings.ReplaceAll(mediaType, " ", "")
+		if mediaType == api.MediaTypeFormatAndVersion || mediaType == "*/*" || mediaType == "application/*" {
+			return
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"error": "this webhook only serves " + api.MediaTypeFormatAndVersion})
+}
+
+// Decodes the request body into obj, optionally rejecting unknown fields
+// Aborts the request with a 400 on failure
+func (p *Provider) bindJSON(c *gin.Context, obj any) bool {
+	data, err := readBody(c)
+	if err != nil {
+		p.abortUnreadable(c, err)
+		return false
+	}
+	if err := p.decodeJSON(data, obj); err != nil {
+		p.abortBadRequest(c, err)
+		return false
+	}
+	return true
+}
+
+// Decodes the request body as either a single plan or an array of plans
+// Aborts the request with a 400 on failure
+func (p *Provider) bindChanges(c *gin.Context) ([]plan.Changes, bool) {
+	data, err := readBody(c)
+	if err != nil {
+		p.abortUnreadable(c, err)
+		return nil, false
+	}
+
+	var plans []plan.Changes
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = p.decodeJSON(data, &plans)
+	} else {
+		plans = make([]plan.Changes, 1)
+		err = p.decodeJSON(data, &plans[0])
+	}
+	if err != nil {
+		p.abortBadRequest(c, err)
+		return nil, false
+	}
+	return plans, true
+}
+
+// Reads the request body, keeping it so that it can be logged if the handler panics
+func readBody(c *gin.Context) ([]byte, error) {
+	data, err := c.GetRawData()
+	if err == nil {
+		c.Set(gin.BodyBytesKey, data)
+	}
+	return data, err
+}
+
+func (p *Provider) decodeJSON(data []byte, obj any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if p.opts.StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(obj)
+}
+
+// Aborts a request whose body couldn't be read, with a 413 if it was too large or else a 400
+func (p *Provider) abortUnreadable(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if stderrors.As(err, &tooLarge) {
+		_ = c.Error(err)
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)})
+		return
+	}
+	p.abortBadRequest(c, err)
+}
+
+func (p *Provider) abortBadRequest(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 }
 
 func (p *Provider) getHealth(c *gin.Context) {
 	c.String(http.StatusOK, "OK")
 }
 
+// Unlike getHealth, this fails when the ConfigMap can't be read, so that traffic isn't sent to a broken pod
+func (p *Provider) getReady(c *gin.Context) {
+	if err := p.storage.Ready(); err != nil {
+		c.String(http.StatusServiceUnavailable, err.Error())
+	} else if _, err := p.storage.Load(c); err != nil {
+		c.String(http.StatusServiceUnavailable, err.Error())
+	} else {
+		c.String(http.StatusOK, "OK")
+	}
+}
+
 func (p *Provider) getDomainFilter(c *gin.Context) {
 	c.Header(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
 	c.JSON(http.StatusOK, p.domainFilter)
 }
 
+func (p *Provider) getCapabilities(c *gin.Context) {
+	features := p.storage.Features()
+	features["strictJSON"] = p.opts.StrictJSON
+	features["sanitizePanics"] = !p.opts.VerbosePanics
+
+	c.JSON(http.StatusOK, capabilities{
+		RecordTypes:    slices.Clone(p.opts.RecordTypes),
+		AllowWildcards: p.opts.AllowWildcards,
+		OutputFormat:   "coredns",
+		Features:       features,
+	})
+}
+
+// Reports the stored record counts and when they were last saved, for quick operational checks
+func (p *Provider) getStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, p.storage.Status())
+}
+
+// Lists the records left out of the rendered config, and why
+func (p *Provider) getSkipped(c *gin.Context) {
+	c.JSON(http.StatusOK, p.storage.Skipped())
+}
+
+// Returns the stored records, or with ?rendered=true, only those which are rendered into the config
 func (p *Provider) getRecords(c *gin.Context) {
+	rendered, err := strconv.ParseBool(c.DefaultQuery("rendered", "false"))
+	if err != nil {
+		p.abortBadRequest(c, err)
+		return
+	}
 	if records, err := p.storage.Load(c); err != nil {
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
 	} else {
+		if rendered {
+			records = p.storage.RenderedRecords(records)
+		}
 		c.Header(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
 		c.JSON(http.StatusOK, records)
 	}
 }
 
+// Applies one or more plans, in order, with a single Save
 func (p *Provider) changeRecords(c *gin.Context) {
-	var changes plan.Changes
-	if err := c.BindJSON(&changes); err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+	defer func() {
+		observeChangeRequest(c.Writer.Status())
+	}()
+
+	plans, ok := p.bindChanges(c)
+	if !ok {
 		return
 	}
 
-	log.Debugf("Received plan: %+v", changes)
-	newRecords, err := p.storage.Load(c)
-	if err != nil {
+	var invalidErr error
+	var applied []plan.Changes
+	err := p.storage.Modify(c, func(newRecords []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		// Modify may retry against a newer ConfigMap, in which case we start over
+		applied = nil
+		for _, changes := range plans {
+			log.Debugf("Received plan: %+v", changes)
+			var err error
+			if changes, err = filterUnknownTypes(changes, p.storage.unknownTypePolicy()); err != nil {
+				invalidErr = err
+				return nil, err
+			}
+			newRecords = applyChanges(newRecords, changes)
+			applied = append(applied, changes)
+		}
+		log.Debugf("New records: %+v", newRecords)
+		return newRecords, nil
+	})
+
+	if invalidErr != nil {
+		p.abortBadRequest(c, invalidErr)
+	} else if err != nil {
 		_ = c.AbortWithError(http.StatusInternalServerError, err)
+	} else {
+		for _, changes := range applied {
+			observeChanges(changes)
+		}
+		c.Header(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
+		c.Status(http.StatusNoContent)
 	}
+}
+
+// Reports whether endpoints of the record type are accepted when adjusting
+// Types unknown to external-dns bypass the allow-list under the store policy, which exists to keep them.
+func (p *Provider) allowsRecordType(recordType string) bool {
+	if !isKnownRecordType(recordType) && p.storage.unknownTypePolicy() == UnknownTypeStore {
+		return true
+	}
+	return slices.Contains(p.opts.RecordTypes, recordType)
+}
+
+// Removes repeated targets, keeping the first occurrence of each
+func uniqueTargets(targets endpoint.Targets) endpoint.Targets {
+	unique := make(endpoint.Targets, 0, len(targets))
+	for _, target := range targets {
+		if !slices.Contains(unique, target) {
+			unique = append(unique, target)
+		}
+	}
+	return unique
+}
+
+func applyChanges(newRecords []*endpoint.Endpoint, changes plan.Changes) []*endpoint.Endpoint {
+	changes.Create = canonicalizeRecords(changes.Create)
+	changes.UpdateOld = canonicalizeRecords(changes.UpdateOld)
+	changes.UpdateNew = canonicalizeRecords(changes.UpdateNew)
+	changes.Delete = canonicalizeRecords(changes.Delete)
+	// Records are matched on their type as well as name, so that e.g. a dual-stack host's A and AAAA records
+	// can be changed independently
 	for _, ep := range changes.Delete {
 		newRecords = slices.DeleteFunc(newRecords, func(e *endpoint.Endpoint) bool {
-			return e.DNSName == ep.DNSName && e.SetIdentifier == ep.SetIdentifier
+			return recordKey(e) == recordKey(ep)
 		})
 	}
 	for _, ep := range changes.UpdateOld {
-		newRecords = slices.DeleteFunc(changes.UpdateOld, func(e *endpoint.Endpoint) bool {
-			return e.DNSName == ep.DNSName && e.SetIdentifier == ep.SetIdentifier
+		newRecords = slices.DeleteFunc(newRecords, func(e *endpoint.Endpoint) bool {
+			return recordKey(e) == recordKey(ep)
 		})
 	}
 	for _, ep := range changes.UpdateNew {
@@ -83,34 +426,53 @@ func (p *Provider) changeRecords(c *gin.Context) {
 	for _, ep := range changes.Create {
 		newRecords = append(newRecords, ep)
 	}
-	log.Debugf("New records: %+v", newRecords)
-
-	if err := p.storage.Save(c, newRecords); err != nil {
-		_ = c.AbortWithError(http.StatusInternalServerError, err)
-	} else {
-		c.Header(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
-		c.Status(http.StatusNoContent)
-	}
+	return newRecords
 }
 
 // Called by the consumer to canonicalize endpoints
-// The only change we make is potentially stripping out wildcard entries
+// We canonicalize names and targets, drop endpoints without a name, with a disallowed record type or which can't be rendered,
+// and potentially strip out wildcard entries
 func (p *Provider) takeAdjust(c *gin.Context) {
 	var desiredEndpoints []*endpoint.Endpoint
-	if err := c.BindJSON(&desiredEndpoints); err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+	if !p.bindJSON(c, &desiredEndpoints) {
 		return
 	}
 
 	log.Debugf("Pre-adjust endpoints: %+v", desiredEndpoints)
 	finalEndpoints := make([]*endpoint.Endpoint, 0, len(desiredEndpoints))
 	for _, ep := range desiredEndpoints {
-		if ep.DNSName[0] == '*' && !p.allowWildcards {
+		ep.DNSName = canonicalName(ep.DNSName)
+		if ep.DNSName == "" {
+			recordLog(ep).Warnf("Endpoint (%s) has an empty DNS name. Dropping.", ep.RecordType)
+			continue
+		}
+		if ep.DNSName[0] == '*' && !p.opts.AllowWildcards {
 			continue
 		}
+		if !p.allowsRecordType(ep.RecordType) {
+			recordLog(ep).Warnf("Endpoint \"%s\" uses record type \"%s\", which isn't allowed. Dropping.", ep.DNSName, ep.RecordType)
+			continue
+		}
+		// Drop anything the renderer would skip, so that external-dns doesn't keep trying to create it
+		if !isSafeName(ep.DNSName) || isMalformedWildcard(ep.DNSName) {
+			recordLog(ep).Warnf("Endpoint %q has a name which can't be rendered. Dropping.", ep.DNSName)
+			continue
+		}
+		if slices.ContainsFunc(ep.Targets, func(target string) bool { return !isSafeTarget(ep.RecordType, target) }) {
+			recordLog(ep).Warnf("Endpoint \"%s\" has a target which can't be rendered. Dropping.", ep.DNSName)
+			continue
+		}
+		ep.Targets = uniqueTargets(ep.Targets)
+		if ep.RecordType == endpoint.RecordTypeA || ep.RecordType == endpoint.RecordTypeAAAA {
+			if ep = filterInvalidAddresses(ep, &skipList{}); ep == nil {
+				continue
+			}
+		}
 		finalEndpoints = append(finalEndpoints, ep)
 	}
 	log.Debugf("Post-adjust endpoints: %+v", finalEndpoints)
+	// external-dns adjusts every record it wants on each sync, so these are all still in use
+	p.storage.MarkSeen(finalEndpoints)
 
 	c.Header(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
 	c.JSON(http.StatusOK, finalEndpoints[:])
@@ -0,0 +1,772 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/provider/webhook/api"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Creates a Provider over a Storage backed by a fake clientset
+func newTestProvider(t *testing.T, opts ProviderOptions, storageOpts StorageOptions) *Provider {
+	t.Helper()
+	if storageOpts.DefaultTTL == 0 {
+		storageOpts.DefaultTTL = 300
+	}
+	s, _ := newTestStorage(t, storageOpts)
+	return NewProvider(endpoint.NewDomainFilter(nil), s, opts)
+}
+
+// Sends a request to the provider, returning the recorded response
+func serveTest(p *Provider, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+// Decodes the error message from a response body
+func responseError(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response body %q isn't a JSON error: %v", w.Body.String(), err)
+	}
+	return body.Error
+}
+
+func TestHandlerPanicsReturnStructuredError(t *testing.T) {
+	tests := []struct {
+		name    string
+		verbose bool
+		want    string
+	}{
+		{"sanitized by default", false, "internal server error"},
+		{"verbose", true, "internal server error: bad record"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{VerbosePanics: tt.verbose}, StorageOptions{})
+			p.POST("/panic", func(c *gin.Context) {
+				var records []*endpoint.Endpoint
+				p.bindJSON(c, &records)
+				panic("bad record")
+			})
+
+			w := serveTest(p, http.MethodPost, "/panic", `[{"dnsName":"a.example.com"}]`)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("got status %d, want 500", w.Code)
+			}
+			if got := responseError(t, w); got != tt.want {
+				t.Errorf("got error %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestBodyIsKeptForPanicLogs(t *testing.T) {
+	p := newTestProvider(t, ProviderOptions{}, StorageOptions{})
+	var kept []byte
+	p.POST("/body", func(c *gin.Context) {
+		var records []*endpoint.Endpoint
+		p.bindJSON(c, &records)
+		if body, ok := c.Get(gin.BodyBytesKey); ok {
+			kept = body.([]byte)
+		}
+	})
+
+	body := `[{"dnsName":"a.example.com"}]`
+	serveTest(p, http.MethodPost, "/body", body)
+	if !bytes.Equal(kept, []byte(body)) {
+		t.Errorf("kept body %q, want %q", kept, body)
+	}
+}
+
+func TestStrictJSONRejectsUnknownFields(t *testing.T) {
+	body := `{"Create":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]}],"Bogus":true}`
+	tests := []struct {
+		name   string
+		strict bool
+		want   int
+	}{
+		{"lenient", false, http.StatusNoContent},
+		{"strict", true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{StrictJSON: tt.strict}, StorageOptions{})
+			w := serveTest(p, http.MethodPost, "/records", body)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			if tt.strict && !strings.Contains(responseError(t, w), "Bogus") {
+				t.Errorf("error %q doesn't name the unknown field", responseError(t, w))
+			}
+		})
+	}
+}
+
+func TestFailedInitialSyncStartsUnready(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("apiserver is down")
+	})
+	s := newTestStorageWithClient(t, client, StorageOptions{DefaultTTL: 300, FailFast: false})
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+	if w := serveTest(p, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("/healthz returned %d, want 200", w.Code)
+	}
+	w := serveTest(p, http.MethodGet, "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d, want 503", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "apiserver is down") {
+		t.Errorf("/readyz body %q doesn't explain the failure", w.Body.String())
+	}
+}
+
+func TestHandlerPanicsAreLogged(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	p := newTestProvider(t, ProviderOptions{}, StorageOptions{})
+	p.GET("/panic", func(*gin.Context) {
+		panic("bad record")
+	})
+
+	if w := serveTest(p, http.MethodGet, "/panic", ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want 500", w.Code)
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.ErrorLevel && entry.Data["panic"] == "bad record" {
+			return
+		}
+	}
+	t.Error("panic wasn't logged as an error")
+}
+
+// Counts the writes made to ConfigMaps through the fake clientset
+func countWrites(client *fake.Clientset) int {
+	writes := 0
+	for _, action := range client.Actions() {
+		if action.GetResource().Resource == "configmaps" && (action.GetVerb() == "create" || action.GetVerb() == "update") {
+			writes++
+		}
+	}
+	return writes
+}
+
+func TestBatchedPlansAreSavedOnce(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t)})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+	client.ClearActions()
+
+	body := `[
+		{"Create":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]}]},
+		{"Create":[{"dnsName":"b.example.com","recordType":"A","targets":["10.0.0.2"]}]}
+	]`
+	if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+	if writes := countWrites(client); writes != 1 {
+		t.Errorf("got %d writes, want a single combined save", writes)
+	}
+	if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("stored %v, want both plans' records", got)
+	}
+}
+
+func TestDomainFilterRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter endpoint.DomainFilter
+	}{
+		{"plain", endpoint.NewDomainFilterWithExclusions([]string{"example.com"}, []string{"private.example.com"})},
+		{"regex", endpoint.NewRegexDomainFilter(regexp.MustCompile(`\.example\.com$`), regexp.MustCompile(`^private\.`))},
+	}
+	names := []string{"www.example.com", "private.example.com", "example.org"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+			p := NewProvider(tt.filter, s, ProviderOptions{})
+			w := serveTest(p, http.MethodGet, "/", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", w.Code)
+			}
+
+			// external-dns' webhook client decodes the filter with DomainFilter's own unmarshaler
+			var decoded endpoint.DomainFilter
+			if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil {
+				t.Fatalf("external-dns can't decode %s: %v", w.Body, err)
+			}
+			for _, name := range names {
+				if decoded.Match(name) != tt.filter.Match(name) {
+					t.Errorf("decoded filter matches %s: %v, want %v", name, decoded.Match(name), tt.filter.Match(name))
+				}
+			}
+		})
+	}
+}
+
+func TestRequireAPIVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		want        int
+	}{
+		{"matching", api.MediaTypeFormatAndVersion, api.MediaTypeFormatAndVersion, http.StatusNoContent},
+		{"no accept header", "", api.MediaTypeFormatAndVersion, http.StatusNoContent},
+		{"wildcard accept", "*/*", api.MediaTypeFormatAndVersion, http.StatusNoContent},
+		{"wrong accept", "application/external.dns.webhook+json;version=2", api.MediaTypeFormatAndVersion, http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{RequireAPIVersion: true}, StorageOptions{})
+			req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{}`))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// Without the flag, any Accept header is fine
+	p := newTestProvider(t, ProviderOptions{}, StorageOptions{})
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{}`))
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d without --require-api-version, want 204", w.Code)
+	}
+}
+
+// Posts the endpoints to /adjustendpoints, returning those which are kept
+func adjustTest(t *testing.T, p *Provider, body string) []*endpoint.Endpoint {
+	t.Helper()
+	w := serveTest(p, http.MethodPost, "/adjustendpoints", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var adjusted []*endpoint.Endpoint
+	if err := json.Unmarshal(w.Body.Bytes(), &adjusted); err != nil {
+		t.Fatal(err)
+	}
+	return adjusted
+}
+
+func TestAdjustDropsEmptyNames(t *testing.T) {
+	p := newTestProvider(t, ProviderOptions{}, StorageOptions{})
+	adjusted := adjustTest(t, p, `[
+		{"dnsName":"","recordType":"A","targets":["10.0.0.1"]},
+		{"dnsName":".","recordType":"A","targets":["10.0.0.2"]},
+		{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.3"]}
+	]`)
+	if got := recordNames(adjusted); !slices.Equal(got, []string{"a.example.com"}) {
+		t.Errorf("adjusted to %v, want only a.example.com", got)
+	}
+}
+
+func TestConcurrentChangesAreAllKept(t *testing.T) {
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+	const requests = 20
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"Create":[{"dnsName":"host%d.example.com","recordType":"A","targets":["10.0.0.%d"]}]}`, i, i)
+			if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+				t.Errorf("request %d got status %d: %s", i, w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if records := loadTestRecords(t, s); len(records) != requests {
+		t.Errorf("stored %d records, want %d: %v", len(records), requests, recordNames(records))
+	}
+}
+
+// Creates a Provider whose ConfigMap can't be read, once the initial sync is done
+func newUnreadableTestProvider(t *testing.T) (*Provider, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	s := newTestStorageWithClient(t, client, StorageOptions{DefaultTTL: 300})
+	client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("configmaps"), testName, stderrors.New("access denied"))
+	})
+	client.ClearActions()
+	return NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{}), client
+}
+
+func TestFailedLoadPreventsSave(t *testing.T) {
+	p, client := newUnreadableTestProvider(t)
+	serveTest(p, http.MethodPost, "/records", `{"Create":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]}]}`)
+	if writes := countWrites(client); writes != 0 {
+		t.Errorf("got %d writes after the load failed, want none", writes)
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        int
+	}{
+		{"matching", api.MediaTypeFormatAndVersion, http.StatusNoContent},
+		{"with spaces", "application/external.dns.webhook+json; version=1", http.StatusNoContent},
+		{"plain json", "application/json", http.StatusUnsupportedMediaType},
+		{"missing", "", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{RequireAPIVersion: true}, StorageOptions{})
+			req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{}`))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Content-Type"); w.Code == http.StatusUnsupportedMediaType && got != api.MediaTypeFormatAndVersion {
+				t.Errorf("415 response has Content-Type %q, want %q", got, api.MediaTypeFormatAndVersion)
+			}
+		})
+	}
+}
+
+func TestAdjustDropsDisallowedRecordTypes(t *testing.T) {
+	p := newTestProvider(t, ProviderOptions{RecordTypes: []string{endpoint.RecordTypeA}}, StorageOptions{})
+	adjusted := adjustTest(t, p, `[
+		{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]},
+		{"dnsName":"_sip._tcp.example.com","recordType":"SRV","targets":["10 60 5060 sip.example.com"]}
+	]`)
+	if len(adjusted) != 1 || adjusted[0].RecordType != endpoint.RecordTypeA {
+		t.Errorf("adjusted to %v, want only the A record", adjusted)
+	}
+}
+
+func TestAdjustUnknownRecordTypes(t *testing.T) {
+	tests := []struct {
+		policy UnknownTypePolicy
+		kept   bool
+	}{
+		{UnknownTypeStore, true},
+		{UnknownTypeSkip, false},
+		{UnknownTypeReject, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{}, StorageOptions{UnknownTypePolicy: tt.policy})
+			adjusted := adjustTest(t, p, `[
+				{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]},
+				{"dnsName":"example.com","recordType":"CAA","targets":["0 issue ca.example.net"]},
+				{"dnsName":"1.0.0.10.in-addr.arpa","recordType":"PTR","targets":["a.example.com"]}
+			]`)
+			want := []string{endpoint.RecordTypeA}
+			if tt.kept {
+				want = append(want, "CAA")
+			}
+			var got []string
+			for _, ep := range adjusted {
+				got = append(got, ep.RecordType)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("adjusted to types %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestChangesUnknownTypePolicies(t *testing.T) {
+	tests := []struct {
+		policy     UnknownTypePolicy
+		wantStatus int
+		wantStored []string
+	}{
+		{UnknownTypeStore, http.StatusNoContent, []string{"a.example.com", "caa.example.com"}},
+		{UnknownTypeSkip, http.StatusNoContent, []string{"a.example.com"}},
+		{UnknownTypeReject, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, UnknownTypePolicy: tt.policy})
+			p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+			body := `{"Create":[
+				{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]},
+				{"dnsName":"caa.example.com","recordType":"CAA","targets":["0 issue ca.example.net"]}
+			]}`
+			if w := serveTest(p, http.MethodPost, "/records", body); w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, tt.wantStored) {
+				t.Errorf("stored %v, want %v", got, tt.wantStored)
+			}
+			if tt.wantStored != nil {
+				// Unknown types are never rendered, even when they're stored
+				assertNotContains(t, getTestConfigMap(t, client, testName).Data["config"], "caa.example.com")
+			}
+		})
+	}
+}
+
+func TestUpdateRoundTripsRecordFields(t *testing.T) {
+	untouched := endpoint.NewEndpoint("keep.example.com", endpoint.RecordTypeA, "10.0.0.9").
+		WithSetIdentifier("blue").WithProviderSpecific(providerSpecificPriority, "1")
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t,
+		untouched,
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1").WithSetIdentifier("green"),
+	)})
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+	body := `{
+		"UpdateOld":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"],"setIdentifier":"green"}],
+		"UpdateNew":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.2"],"setIdentifier":"green",
+			"providerSpecific":[{"name":"configmap/ttl","value":"60"}]}]
+	}`
+	if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+
+	records := loadTestRecords(t, s)
+	got := recordNames(records)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"a.example.com", "keep.example.com"}) {
+		t.Fatalf("stored %v, want the updated and untouched records", got)
+	}
+	for _, ep := range records {
+		switch ep.DNSName {
+		case "a.example.com":
+			if ttl, _ := ep.GetProviderSpecificProperty(providerSpecificTTL); ttl != "60" || ep.SetIdentifier != "green" || !slices.Equal(ep.Targets, endpoint.Targets{"10.0.0.2"}) {
+				t.Errorf("updated record came back as %v", ep)
+			}
+		case "keep.example.com":
+			if ep.SetIdentifier != untouched.SetIdentifier || !slices.Equal(ep.ProviderSpecific, untouched.ProviderSpecific) {
+				t.Errorf("untouched record came back as %v, want %v", ep, untouched)
+			}
+		}
+	}
+}
+
+func TestChangesCanonicalizeNames(t *testing.T) {
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+	body := `{"Create":[
+		{"dnsName":"WWW.Example.com.","recordType":"A","targets":["10.0.0.1"]},
+		{"dnsName":"www.example.com","recordType":"A","targets":["10.0.0.1"]}
+	]}`
+	if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+	if got := recordNames(loadTestRecords(t, s)); !slices.Equal(got, []string{"www.example.com"}) {
+		t.Errorf("stored %v, want a single canonical record", got)
+	}
+
+	// Deleting by a non-canonical name still matches
+	body = `{"Delete":[{"dnsName":"Www.Example.Com.","recordType":"A","targets":["10.0.0.1"]}]}`
+	if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+	if got := recordNames(loadTestRecords(t, s)); len(got) != 0 {
+		t.Errorf("stored %v after deleting the record", got)
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		method, path  string
+		authorization string
+		want          int
+	}{
+		{"authorized change", http.MethodPost, "/records", "Bearer secret", http.StatusNoContent},
+		{"missing token", http.MethodPost, "/records", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "/records", "Bearer guess", http.StatusUnauthorized},
+		{"wrong scheme", http.MethodPost, "/records", "Basic secret", http.StatusUnauthorized},
+		{"unauthorized adjust", http.MethodPost, "/adjustendpoints", "", http.StatusUnauthorized},
+		{"health checks are open", http.MethodGet, "/healthz", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{AuthToken: "secret"}, StorageOptions{})
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderedRecordsFilter(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{"records": marshalTestRecords(t,
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("1.0.0.10.in-addr.arpa", endpoint.RecordTypePTR, "a.example.com"),
+	)})
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/records", []string{"a.example.com", "1.0.0.10.in-addr.arpa"}},
+		{"/records?rendered=true", []string{"a.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := serveTest(p, http.MethodGet, tt.path, "")
+			var records []*endpoint.Endpoint
+			if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+				t.Fatalf("response %q isn't a list of records: %v", w.Body, err)
+			}
+			if got := recordNames(records); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if w := serveTest(p, http.MethodGet, "/records?rendered=maybe", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid filter, want 400", w.Code)
+	}
+}
+
+func TestDualStackRecordsCoexist(t *testing.T) {
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+
+	body := `{"Create":[
+		{"dnsName":"dual.example.com","recordType":"A","targets":["10.0.0.1"]},
+		{"dnsName":"dual.example.com","recordType":"AAAA","targets":["2001:db8::1"]}
+	]}`
+	if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+	// Changing one family leaves the other alone
+	body = `{"UpdateOld":[{"dnsName":"dual.example.com","recordType":"A","targets":["10.0.0.1"]}],
+		"UpdateNew":[{"dnsName":"dual.example.com","recordType":"A","targets":["10.0.0.2"]}]}`
+	if w := serveTest(p, http.MethodPost, "/records", body); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+
+	assertContainsLines(t, getTestConfigMap(t, client, testName).Data["config"],
+		"10.0.0.2 dual.example.com",
+		"2001:db8::1 dual.example.com",
+	)
+}
+
+func TestFailedLoadReturns500(t *testing.T) {
+	p, client := newUnreadableTestProvider(t)
+	tests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/records", ""},
+		{http.MethodPost, "/records", `{"Create":[{"dnsName":"a.example.com","recordType":"A","targets":["10.0.0.1"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			w := serveTest(p, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("got status %d, want 500", w.Code)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("got body %q after the failure, want none", w.Body)
+			}
+		})
+	}
+	if writes := countWrites(client); writes != 0 {
+		t.Errorf("got %d writes after the load failed, want none", writes)
+	}
+}
+
+func TestSkippedRecordsAreListed(t *testing.T) {
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300})
+	p := NewProvider(endpoint.NewDomainFilter(nil), s, ProviderOptions{})
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("bogus.example.com", endpoint.RecordTypeA, "not-an-ip"),
+			endpoint.NewEndpoint("*foo.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+			endpoint.NewEndpoint("1.0.0.10.in-addr.arpa", endpoint.RecordTypePTR, "a.example.com"),
+		}
+	})
+
+	w := serveTest(p, http.MethodGet, "/skipped", "")
+	var skipped []SkippedRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &skipped); err != nil {
+		t.Fatalf("response %q isn't a list of skipped records: %v", w.Body, err)
+	}
+	want := []SkippedRecord{
+		{"*foo.example.com", endpoint.RecordTypeA, skipReasonMalformedWildcard},
+		{"1.0.0.10.in-addr.arpa", endpoint.RecordTypePTR, skipReasonUnsupportedType},
+		{"bogus.example.com", endpoint.RecordTypeA, skipReasonInvalidTargets},
+	}
+	slices.SortFunc(skipped, func(a, b SkippedRecord) int { return strings.Compare(a.DNSName, b.DNSName) })
+	if !slices.Equal(skipped, want) {
+		t.Errorf("got skipped records %+v, want %+v", skipped, want)
+	}
+}
+
+func TestAdjustNormalizesRecords(t *testing.T) {
+	p := newTestProvider(t, ProviderOptions{}, StorageOptions{})
+	adjusted := adjustTest(t, p, `[
+		{"dnsName":"WWW.Example.COM.","recordType":"A","targets":["10.0.0.1","10.0.0.1"]},
+		{"dnsName":"_sip._tcp.example.com","recordType":"SRV","targets":["10 60 5060 sip.example.com"]},
+		{"dnsName":"_bad._tcp.example.com","recordType":"SRV","targets":["10 60 5060 sip}.example.com"]},
+		{"dnsName":"bogus.example.com","recordType":"A","targets":["not-an-ip"]}
+	]`)
+
+	want := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("_sip._tcp.example.com", endpoint.RecordTypeSRV, "10 60 5060 sip.example.com"),
+	}
+	if !slices.EqualFunc(adjusted, want, func(a, b *endpoint.Endpoint) bool { return a.String() == b.String() }) {
+		t.Errorf("adjusted to %v, want %v", adjusted, want)
+	}
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	p := newTestProvider(t, ProviderOptions{MaxRequestSize: 1024}, StorageOptions{})
+	create := `{"Create": [{"dnsName": "a.example.com", "recordType": "A", "targets": ["10.0.0.1"]}]}`
+	huge := `{"Create": [{"dnsName": "a.example.com", "recordType": "TXT", "targets": ["` + strings.Repeat("x", 2048) + `"]}]}`
+
+	if w := serveTest(p, http.MethodPost, "/records", create); w.Code != http.StatusNoContent {
+		t.Errorf("got status %d for a small change, want 204: %s", w.Code, w.Body)
+	}
+	for _, path := range []string{"/records", "/adjustendpoints"} {
+		if w := serveTest(p, http.MethodPost, path, huge); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got status %d posting an over-limit body to %s, want 413: %s", w.Code, path, w.Body)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	p := newTestProvider(t, ProviderOptions{}, StorageOptions{})
+	create := `{"Create": [{"dnsName": "a.example.com", "recordType": "A", "targets": ["10.0.0.1"]}]}`
+	if w := serveTest(p, http.MethodPost, "/records", create); w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204: %s", w.Code, w.Body)
+	}
+
+	w := serveTest(p, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	for _, name := range []string{
+		"external_dns_configmap_stored_records",
+		"external_dns_configmap_records_applied_total",
+		"external_dns_configmap_change_requests_total",
+	} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("metrics are missing %s", name)
+		}
+	}
+}
+
+func TestCapabilitiesReflectOptions(t *testing.T) {
+	p := newTestProvider(t,
+		ProviderOptions{AllowWildcards: true, StrictJSON: true, RecordTypes: []string{endpoint.RecordTypeA, endpoint.RecordTypeTXT}},
+		StorageOptions{AddFinalizer: true, PruneAfter: time.Hour},
+	)
+	w := serveTest(p, http.MethodGet, "/capabilities", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var got capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.RecordTypes, []string{endpoint.RecordTypeA, endpoint.RecordTypeTXT}) {
+		t.Errorf("got record types %v, want the configured ones", got.RecordTypes)
+	}
+	if !got.AllowWildcards || got.OutputFormat != "coredns" {
+		t.Errorf("got %+v, want wildcards allowed and coredns output", got)
+	}
+	for feature, want := range map[string]bool{
+		"strictJSON":       true,
+		"sanitizePanics":   true,
+		"addFinalizer":     true,
+		"prune":            true,
+		"recreateOnDelete": false,
+		"noRender":         false,
+	} {
+		if enabled, ok := got.Features[feature]; !ok || enabled != want {
+			t.Errorf("got feature %s = %v (present: %v), want %v", feature, enabled, ok, want)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []string
+		remoteAddr string
+		want       string
+	}{
+		{"trusted peer", []string{"10.0.0.0/8"}, "10.1.2.3:40000", "192.0.2.7"},
+		{"untrusted peer", []string{"10.0.0.0/8"}, "203.0.113.5:40000", "203.0.113.5"},
+		{"no trusted proxies", nil, "10.1.2.3:40000", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, ProviderOptions{TrustedProxies: tt.trusted}, StorageOptions{})
+			p.GET("/test/client", func(c *gin.Context) {
+				c.String(http.StatusOK, c.ClientIP())
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/test/client", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "192.0.2.7")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("got client IP %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
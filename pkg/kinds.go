@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The kind of object which records are stored in
+type StorageKind string
+
+const (
+	StorageKindConfigMap StorageKind = "configmap"
+	StorageKindSecret    StorageKind = "secret"
+)
+
+// StorageKinds lists the kinds which can be selected
+var StorageKinds = []StorageKind{StorageKindConfigMap, StorageKindSecret}
+
+// Reads and writes the object which records are stored in
+// Whatever the kind, objects are handled as ConfigMaps, as they're the simplest string-keyed type
+type objectClient interface {
+	Get(ctx context.Context, name string) (*corev1.ConfigMap, error)
+	Create(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error)
+	Update(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error)
+	// Registers an informer for the kind with the factory
+	informer(factory informers.SharedInformerFactory) cache.SharedIndexInformer
+	// Converts between the kind's own type, as held by its informer, and a ConfigMap
+	fromObject(obj any) (*corev1.ConfigMap, bool)
+	toObject(cm *corev1.ConfigMap) runtime.Object
+}
+
+func newObjectClient(kind StorageKind, c kubernetes.Interface, namespace string) objectClient {
+	if kind == StorageKindSecret {
+		return secretClient{c, namespace}
+	}
+	return configMapClient{c, namespace}
+}
+
+type configMapClient struct {
+	c         kubernetes.Interface
+	namespace string
+}
+
+func (c configMapClient) Get(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	return c.c.CoreV1().ConfigMaps(c.namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c configMapClient) Create(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return c.c.CoreV1().ConfigMaps(c.namespace).Create(ctx, cm, metav1.CreateOptions{})
+}
+
+func (c configMapClient) Update(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return c.c.CoreV1().ConfigMaps(c.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+}
+
+func (c configMapClient) informer(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+	return factory.Core().V1().ConfigMaps().Informer()
+}
+
+func (c configMapClient) fromObject(obj any) (*corev1.ConfigMap, bool) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return nil, false
+	}
+	return cm.DeepCopy(), true
+}
+
+func (c configMapClient) toObject(cm *corev1.ConfigMap) runtime.Object {
+	return cm
+}
+
+// Stores records in a Secret, for when the records or config shouldn't be readable by everyone who can read ConfigMaps
+type secretClient struct {
+	c         kubernetes.Interface
+	namespace string
+}
+
+func (c secretClient) Get(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	secret, err := c.c.CoreV1().Secrets(c.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secretToConfigMap(secret), nil
+}
+
+func (c secretClient) Create(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	secret, err := c.c.CoreV1().Secrets(c.namespace).Create(ctx, configMapToSecret(cm), metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secretToConfigMap(secret), nil
+}
+
+func (c secretClient) Update(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	secret, err := c.c.CoreV1().Secrets(c.namespace).Update(ctx, configMapToSecret(cm), metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secretToConfigMap(secret), nil
+}
+
+func (c secretClient) informer(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+	return factory.Core().V1().Secrets().Informer()
+}
+
+func (c secretClient) fromObject(obj any) (*corev1.ConfigMap, bool) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, false
+	}
+	return secretToConfigMap(secret), true
+}
+
+func (c secretClient) toObject(cm *corev1.ConfigMap) runtime.Object {
+	return configMapToSecret(cm)
+}
+
+func secretToConfigMap(secret *corev1.Secret) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: *secret.ObjectMeta.DeepCopy(),
+		Immutable:  secret.Immutable,
+		Data:       make(map[string]string, len(secret.Data)),
+	}
+	for k, v := range secret.Data {
+		cm.Data[k] = string(v)
+	}
+	return cm
+}
+
+func configMapToSecret(cm *corev1.ConfigMap) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: *cm.ObjectMeta.DeepCopy(),
+		Type:       corev1.SecretTypeOpaque,
+		Immutable:  cm.Immutable,
+		Data:       make(map[string][]byte, len(cm.Data)),
+	}
+	for k, v := range cm.Data {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
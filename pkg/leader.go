@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderElection tracks whether this replica holds the Lease which permits it to modify the records,
+// so that multiple replicas don't fight over the ConfigMap
+type LeaderElection struct {
+	leading atomic.Bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// Called whenever we acquire the Lease, guarded by the mutex
+	onLeading []func()
+	sync.Mutex
+}
+
+// NewLeaderElection starts campaigning for the named Lease, continuing until Close is called
+// The replica's identity is its hostname, which is the pod name when running in-cluster.
+func NewLeaderElection(clientset kubernetes.Interface, namespace, lease string) (*LeaderElection, error) {
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not determine identity")
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: lease, Namespace: namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	le := &LeaderElection{done: make(chan struct{})}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Name:            lease,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Infof("Acquired lease %s/%s. Accepting changes.", namespace, lease)
+				le.Lock()
+				le.leading.Store(true)
+				hooks := slices.Clone(le.onLeading)
+				le.Unlock()
+				for _, hook := range hooks {
+					go hook()
+				}
+			},
+			OnStoppedLeading: func() {
+				log.Warnf("Lost lease %s/%s. Rejecting changes.", namespace, lease)
+				le.leading.Store(false)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("Replica %s holds lease %s/%s", leader, namespace, lease)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not configure leader election")
+	}
+
+	var ctx context.Context
+	ctx, le.cancel = context.WithCancel(context.Background())
+	go func() {
+		defer close(le.done)
+		// Run returns whenever leadership is lost, so campaign again until we're closed
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return le, nil
+}
+
+// IsLeader reports whether this replica currently holds the Lease
+func (le *LeaderElection) IsLeader() bool {
+	return le.leading.Load()
+}
+
+// OnStartedLeading registers fn to be called, in its own goroutine, whenever we acquire the Lease
+// If we already hold it, fn is also called straight away.
+func (le *LeaderElection) OnStartedLeading(fn func()) {
+	le.Lock()
+	le.onLeading = append(le.onLeading, fn)
+	leading := le.leading.Load()
+	le.Unlock()
+	if leading {
+		go fn()
+	}
+}
+
+// Close stops campaigning, releasing the Lease if we hold it
+func (le *LeaderElection) Close() {
+	le.cancel()
+	<-le.done
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+const metricsNamespace = "external_dns_configmap"
+
+// Reasons a record can be skipped while rendering, used as the reason label of recordsSkipped and in SkippedRecord
+const (
+	skipReasonEmptyName         = "empty_name"
+	skipReasonUnknownType       = "unknown_type"
+	skipReasonUnsupportedType   = "unsupported_type"
+	skipReasonUnavailablePlugin = "unavailable_plugin"
+	skipReasonInvalidTargets    = "invalid_targets"
+	skipReasonMalformedWildcard = "malformed_wildcard"
+	skipReasonSetIdentifier     = "set_identifier"
+	skipReasonExcluded          = "excluded"
+	skipReasonUnresolvableAlias = "unresolvable_alias"
+	skipReasonUnsafeName        = "unsafe_name"
+	skipReasonUnsafeTarget      = "unsafe_target"
+	skipReasonOutsideOrigin     = "outside_origin"
+)
+
+var (
+	recordsApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_applied_total",
+		Help:      "Number of records applied from external-dns plans, by action.",
+	}, []string{"action"})
+	recordsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_skipped_total",
+		Help:      "Number of records skipped while rendering the config, by record type and reason.",
+	}, []string{"record_type", "reason"})
+	changeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "change_requests_total",
+		Help:      "Number of requests to apply changes, by outcome.",
+	}, []string{"outcome"})
+	storedRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stored_records",
+		Help:      "Number of records currently stored in each ConfigMap, by record type.",
+	}, []string{"configmap", "record_type"})
+)
+
+func init() {
+	prometheus.MustRegister(recordsApplied, recordsSkipped, changeRequests, storedRecords)
+}
+
+// Counts the records applied by a plan
+func observeChanges(changes plan.Changes) {
+	recordsApplied.WithLabelValues("create").Add(float64(len(changes.Create)))
+	recordsApplied.WithLabelValues("update").Add(float64(len(changes.UpdateNew)))
+	recordsApplied.WithLabelValues("delete").Add(float64(len(changes.Delete)))
+}
+
+// Counts a change request by its response status: success, rejected (4xx) or error (5xx)
+func observeChangeRequest(status int) {
+	outcome := "success"
+	if status >= 500 {
+		outcome = "error"
+	} else if status >= 400 {
+		outcome = "rejected"
+	}
+	changeRequests.WithLabelValues(outcome).Inc()
+}
+
+// Replaces the stored record counts of the named ConfigMap with those of the given records
+// Only that ConfigMap's series are reset, so that each shard's counts are kept.
+func observeStoredRecords(configMap string, records []*endpoint.Endpoint) {
+	counts := make(map[string]int)
+	for _, ep := range records {
+		counts[ep.RecordType]++
+	}
+	storedRecords.DeletePartialMatch(prometheus.Labels{"configmap": configMap})
+	for recordType, count := range counts {
+		storedRecords.WithLabelValues(configMap, recordType).Set(float64(count))
+	}
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+)
+
+// How the targets of each record are ordered when rendered
+type TargetOrder string
+
+const (
+	// Sort the targets, so that the config is deterministic
+	TargetOrderAsc TargetOrder = "asc"
+	// Keep the targets in the order external-dns gave them
+	TargetOrderSource TargetOrder = "source"
+	// Shuffle the targets, to spread load across them
+	TargetOrderRandom TargetOrder = "random"
+)
+
+// TargetOrders lists the orders which can be selected
+var TargetOrders = []TargetOrder{TargetOrderAsc, TargetOrderSource, TargetOrderRandom}
+
+// Orders the targets of each record, copying any records which need to change
+// The records slice is updated in place.
+func (r *Renderer) orderTargets(records []*endpoint.Endpoint) {
+	if r.opts.TargetOrder == TargetOrderSource {
+		return
+	}
+
+	for i, ep := range records {
+		if r.opts.TargetOrder == TargetOrderRandom {
+			if len(ep.Targets) > 1 {
+				ep = ep.DeepCopy()
+				r.shuffle(ep)
+			}
+		} else {
+			if !slices.IsSorted(ep.Targets) {
+				ep = ep.DeepCopy()
+				slices.Sort(ep.Targets)
+			}
+		}
+		records[i] = ep
+	}
+}
+
+// Shuffles a record's targets
+// Each record's shuffle depends only on the seed, its key and its targets, so that it's the same on every render.
+func (r *Renderer) shuffle(ep *endpoint.Endpoint) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(recordKey(ep)))
+	rng := rand.New(rand.NewSource(r.opts.TargetOrderSeed ^ int64(h.Sum64())))
+
+	slices.Sort(ep.Targets)
+	rng.Shuffle(len(ep.Targets), func(a, b int) {
+		ep.Targets[a], ep.Targets[b] = ep.Targets[b], ep.Targets[a]
+	})
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"testing"
+)
+
+func orderTestRecords() []*endpoint.Endpoint {
+	return []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.5", "10.0.0.4"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.1.2", "10.0.1.1"),
+	}
+}
+
+func TestOrderTargets(t *testing.T) {
+	tests := []struct {
+		order TargetOrder
+		want  endpoint.Targets
+	}{
+		{TargetOrderAsc, endpoint.Targets{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}},
+		{TargetOrderSource, endpoint.Targets{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.5", "10.0.0.4"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.order), func(t *testing.T) {
+			records := orderTestRecords()
+			NewRenderer(nil, StorageOptions{TargetOrder: tt.order}).orderTargets(records)
+			if !slices.Equal(records[0].Targets, tt.want) {
+				t.Errorf("got targets %v, want %v", records[0].Targets, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomTargetOrderIsStable(t *testing.T) {
+	r := NewRenderer(nil, StorageOptions{TargetOrder: TargetOrderRandom})
+	if r.opts.TargetOrderSeed == 0 {
+		t.Fatal("random order wasn't seeded")
+	}
+
+	first := orderTestRecords()
+	r.orderTargets(first)
+
+	// Neither the order external-dns gives the targets in nor the other records may change the shuffle
+	second := orderTestRecords()
+	slices.Reverse(second[0].Targets)
+	second = second[:1]
+	r.orderTargets(second)
+
+	if !slices.Equal(first[0].Targets, second[0].Targets) {
+		t.Errorf("shuffle changed between renders: %v, then %v", first[0].Targets, second[0].Targets)
+	}
+	if !slices.Equal(orderTestRecords()[0].Targets, endpoint.Targets{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.5", "10.0.0.4"}) {
+		t.Error("shuffle modified the original records")
+	}
+}
+
+func TestRandomTargetOrderSeed(t *testing.T) {
+	opts := StorageOptions{TargetOrder: TargetOrderRandom, TargetOrderSeed: 42}
+	first, second := orderTestRecords(), orderTestRecords()
+	NewRenderer(nil, opts).orderTargets(first)
+	NewRenderer(nil, opts).orderTargets(second)
+	if !slices.Equal(first[0].Targets, second[0].Targets) {
+		t.Errorf("same seed gave different shuffles: %v and %v", first[0].Targets, second[0].Targets)
+	}
+}
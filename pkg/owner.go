@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OwnerKinds lists the kinds of resource which can own the ConfigMap
+var OwnerKinds = []string{"Deployment", "StatefulSet", "DaemonSet", "Pod"}
+
+// Builds an owner reference to the configured owner, which must be in the ConfigMap's namespace
+// The owner's UID is looked up, as garbage collection requires it
+func (s *Storage) ownerReference(ctx context.Context) (metav1.OwnerReference, error) {
+	c := s.client()
+	var meta *metav1.ObjectMeta
+	apiVersion := "apps/v1"
+	switch s.opts.OwnerKind {
+	case "Deployment":
+		owner, err := c.AppsV1().Deployments(s.namespace).Get(ctx, s.opts.OwnerName, metav1.GetOptions{})
+		if err != nil {
+			return metav1.OwnerReference{}, errors.Wrap(err, "Could not fetch owner")
+		}
+		meta = &owner.ObjectMeta
+	case "StatefulSet":
+		owner, err := c.AppsV1().StatefulSets(s.namespace).Get(ctx, s.opts.OwnerName, metav1.GetOptions{})
+		if err != nil {
+			return metav1.OwnerReference{}, errors.Wrap(err, "Could not fetch owner")
+		}
+		meta = &owner.ObjectMeta
+	case "DaemonSet":
+		owner, err := c.AppsV1().DaemonSets(s.namespace).Get(ctx, s.opts.OwnerName, metav1.GetOptions{})
+		if err != nil {
+			return metav1.OwnerReference{}, errors.Wrap(err, "Could not fetch owner")
+		}
+		meta = &owner.ObjectMeta
+	case "Pod":
+		owner, err := c.CoreV1().Pods(s.namespace).Get(ctx, s.opts.OwnerName, metav1.GetOptions{})
+		if err != nil {
+			return metav1.OwnerReference{}, errors.Wrap(err, "Could not fetch owner")
+		}
+		meta = &owner.ObjectMeta
+		apiVersion = "v1"
+	default:
+		return metav1.OwnerReference{}, fmt.Errorf("unsupported owner kind \"%s\"", s.opts.OwnerKind)
+	}
+
+	return metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       s.opts.OwnerKind,
+		Name:       meta.Name,
+		UID:        meta.UID,
+	}, nil
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"reflect"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Uniquely identifies a record within the stored set
+func recordKey(ep *endpoint.Endpoint) string {
+	return ep.DNSName + "/" + ep.RecordType + "/" + ep.SetIdentifier
+}
+
+// Updates the last-seen timestamps for the given records and drops any which haven't been seen within the window
+//
+// A record is considered seen when it's first stored, whenever its contents change, and whenever external-dns
+// asks for it to be adjusted, as it does for every desired record on each sync; sightings holds the latter.
+// external-dns never adjusts its registry's TXT records, so they're considered seen along with any other sighting.
+// Returns the surviving records and their updated timestamps.
+func pruneStale(records, previous []*endpoint.Endpoint, lastSeen, sightings map[string]time.Time, now time.Time, window time.Duration) ([]*endpoint.Endpoint, map[string]time.Time) {
+	previousByKey := make(map[string]*endpoint.Endpoint, len(previous))
+	for _, ep := range previous {
+		previousByKey[recordKey(ep)] = ep
+	}
+	var lastSighting time.Time
+	for _, sighted := range sightings {
+		if sighted.After(lastSighting) {
+			lastSighting = sighted
+		}
+	}
+
+	kept := make([]*endpoint.Endpoint, 0, len(records))
+	newLastSeen := make(map[string]time.Time, len(records))
+	for _, ep := range records {
+		key := recordKey(ep)
+		seen, ok := lastSeen[key]
+		if prev := previousByKey[key]; !ok || prev == nil || !reflect.DeepEqual(prev, ep) {
+			seen = now
+		}
+		if sighted := sightings[key]; sighted.After(seen) {
+			seen = sighted
+		}
+		if isRegistryRecord(ep) && lastSighting.After(seen) {
+			seen = lastSighting
+		}
+		if now.Sub(seen) > window {
+			log.Infof("Pruning record \"%s\" (%s), last seen %s", ep.DNSName, ep.RecordType, seen.Format(time.RFC3339))
+			continue
+		}
+		kept = append(kept, ep)
+		newLastSeen[key] = seen
+	}
+
+	return kept, newLastSeen
+}
+
+// Whether a record is one of the TXT records which external-dns' registry uses to track ownership
+func isRegistryRecord(ep *endpoint.Endpoint) bool {
+	return ep.RecordType == endpoint.RecordTypeTXT && slices.ContainsFunc(ep.Targets, func(target string) bool {
+		return strings.HasPrefix(unquoteTXT(target), "heritage=external-dns")
+	})
+}
+
+// Notes that external-dns still wants the given records, for pruning
+func (s *Storage) MarkSeen(records []*endpoint.Endpoint) {
+	if s.opts.PruneAfter <= 0 {
+		return
+	}
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	if s.state.sightings == nil {
+		s.state.sightings = map[string]time.Time{}
+	}
+	now := s.clock()
+	for _, ep := range canonicalizeRecords(records) {
+		s.state.sightings[recordKey(ep)] = now
+	}
+}
+
+// Returns a copy of the sightings recorded by MarkSeen
+func (s *Storage) sightings() map[string]time.Time {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	return maps.Clone(s.state.sightings)
+}
+
+// Forgets the sightings of records which are no longer stored, once they've been saved
+func (s *Storage) forgetSightings(stored []*endpoint.Endpoint) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	keys := make(map[string]bool, len(stored))
+	for _, ep := range stored {
+		keys[recordKey(ep)] = true
+	}
+	maps.DeleteFunc(s.state.sightings, func(key string, _ time.Time) bool {
+		return !keys[key]
+	})
+}
+
+// Decodes the records and last-seen data keys of an existing ConfigMap, ignoring malformed data
+func decodePruneState(data map[string]string, recordsKey string) ([]*endpoint.Endpoint, map[string]time.Time) {
+	var previous []*endpoint.Endpoint
+	if err := json.Unmarshal([]byte(data[recordsKey]), &previous); err != nil {
+		previous = nil
+	}
+	lastSeen := map[string]time.Time{}
+	if err := json.Unmarshal([]byte(data["last-seen"]), &lastSeen); err != nil {
+		lastSeen = map[string]time.Time{}
+	}
+	return previous, lastSeen
+}
@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"testing"
+	"time"
+)
+
+func recordNames(records []*endpoint.Endpoint) []string {
+	names := make([]string, 0, len(records))
+	for _, ep := range records {
+		names = append(names, ep.DNSName)
+	}
+	return names
+}
+
+func TestPruneStale(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stale := endpoint.NewEndpoint("stale.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	changed := endpoint.NewEndpoint("changed.example.com", endpoint.RecordTypeA, "10.0.0.2")
+	sighted := endpoint.NewEndpoint("sighted.example.com", endpoint.RecordTypeA, "10.0.0.3")
+	registry := endpoint.NewEndpoint("a-stale.example.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\"")
+	previous := []*endpoint.Endpoint{stale, changed, sighted, registry}
+	lastSeen := map[string]time.Time{}
+	for _, ep := range previous {
+		lastSeen[recordKey(ep)] = start
+	}
+
+	// Two hours later, with a one hour window
+	now := start.Add(2 * time.Hour)
+	changedNow := endpoint.NewEndpoint("changed.example.com", endpoint.RecordTypeA, "10.0.0.20")
+	added := endpoint.NewEndpoint("added.example.com", endpoint.RecordTypeA, "10.0.0.4")
+	records := []*endpoint.Endpoint{stale, changedNow, sighted, registry, added}
+
+	tests := []struct {
+		name      string
+		sightings map[string]time.Time
+		want      []string
+	}{
+		{
+			name: "unsighted records are pruned",
+			want: []string{"changed.example.com", "added.example.com"},
+		},
+		{
+			name:      "sighted records are kept, along with registry records",
+			sightings: map[string]time.Time{recordKey(sighted): now.Add(-time.Minute)},
+			want:      []string{"changed.example.com", "sighted.example.com", "a-stale.example.com", "added.example.com"},
+		},
+		{
+			name:      "old sightings don't keep records",
+			sightings: map[string]time.Time{recordKey(sighted): start.Add(time.Minute)},
+			want:      []string{"changed.example.com", "added.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, newLastSeen := pruneStale(records, previous, lastSeen, tt.sightings, now, time.Hour)
+			if got := recordNames(kept); !slices.Equal(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+			if len(newLastSeen) != len(kept) {
+				t.Errorf("got %d last-seen timestamps for %d records", len(newLastSeen), len(kept))
+			}
+			if seen := newLastSeen[recordKey(added)]; !seen.Equal(now) {
+				t.Errorf("added record last seen %v, want %v", seen, now)
+			}
+		})
+	}
+}
+
+func TestPruneStaleWithinWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ep := endpoint.NewEndpoint("stable.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	records := []*endpoint.Endpoint{ep}
+	lastSeen := map[string]time.Time{recordKey(ep): start}
+
+	kept, newLastSeen := pruneStale(records, records, lastSeen, nil, start.Add(30*time.Minute), time.Hour)
+	if len(kept) != 1 {
+		t.Fatalf("kept %v, want the record", recordNames(kept))
+	}
+	if seen := newLastSeen[recordKey(ep)]; !seen.Equal(start) {
+		t.Errorf("unchanged record last seen %v, want %v", seen, start)
+	}
+}
+
+func TestPruneKeepsSightedRecords(t *testing.T) {
+	clock := newFakeClock()
+	s, _ := newTestStorage(t, StorageOptions{DefaultTTL: 300, PruneAfter: time.Hour})
+	s.clock = clock.Now
+
+	stable := endpoint.NewEndpoint("stable.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	abandoned := endpoint.NewEndpoint("abandoned.example.com", endpoint.RecordTypeA, "10.0.0.2")
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{stable, abandoned}
+	})
+
+	// external-dns keeps adjusting the stable record on each sync, but never changes it
+	for range 4 {
+		clock.Advance(30 * time.Minute)
+		s.MarkSeen([]*endpoint.Endpoint{stable})
+	}
+	modifyTestRecords(t, s, func(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+		return append(records, endpoint.NewEndpoint("new.example.com", endpoint.RecordTypeA, "10.0.0.3"))
+	})
+
+	got := recordNames(loadTestRecords(t, s))
+	if want := []string{"stable.example.com", "new.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"sigs.k8s.io/external-dns/endpoint"
+	"strings"
+)
+
+// Maximum length of a single character-string within a TXT record
+const maxTXTStringLength = 255
+
+// Functions made available to the config template
+var templateFuncs = map[string]any{
+	"rdata":               formatRData,
+	"queryType":           queryType,
+	"matchRegex":          matchRegex,
+	"matchSubdomainRegex": matchSubdomainRegex,
+}
+
+// Returns the query type which a template block for the record type should answer
+// A CNAME applies to queries of every type, and clients mostly ask for A or AAAA records rather than the CNAME itself.
+func queryType(recordType string) string {
+	if recordType == endpoint.RecordTypeCNAME {
+		return "ANY"
+	}
+	return recordType
+}
+
+// Formats a target as the RDATA of a record within a template plugin answer
+func formatRData(recordType, target string) string {
+	switch recordType {
+	case endpoint.RecordTypeTXT:
+		return quoteTXT(unquoteTXT(target))
+	case endpoint.RecordTypeCNAME, endpoint.RecordTypeNS:
+		return fqdn(target)
+	case endpoint.RecordTypeSRV, endpoint.RecordTypeMX:
+		// SRV targets are "priority weight port target", and MX targets "preference exchange"
+		return fqdnLastField(target)
+	default:
+		return target
+	}
+}
+
+// Ensures that a name is fully qualified, as CoreDNS expects of names within answers
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// Ensures that the name at the end of a target such as "10 mail.example.com" is fully qualified
+func fqdnLastField(target string) string {
+	fields := strings.Fields(target)
+	if len(fields) == 0 {
+		return target
+	}
+	fields[len(fields)-1] = fqdn(fields[len(fields)-1])
+	return strings.Join(fields, " ")
+}
+
+// Builds a regex for the template plugin's match directive, matching the given name exactly
+func matchRegex(name string) string {
+	return "^" + regexp.QuoteMeta(name) + `\.$`
+}
+
+// Builds a regex for the template plugin's match directive, matching any name below the given zone
+// The zone itself is excluded so that wildcards don't shadow records at the apex
+func matchSubdomainRegex(zone string) string {
+	return `^.+\.` + regexp.QuoteMeta(zone) + `\.$`
+}
+
+// Strips the quotes which surround some TXT values, such as those of external-dns' TXT registry
+// These quote the value as in a zone file, rather than being part of it, and would otherwise be escaped into it
+func unquoteTXT(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Quotes a TXT value for use within a template plugin answer
+//
+// The answer is itself a quoted Corefile token which only understands \" as an escape, and is then
+// executed as a Go template, so everything significant to either is written using \DDD escapes.
+// Values longer than 255 bytes are split across multiple character-strings.
+func quoteTXT(value string) string {
+	var chunks []string
+	for len(value) > maxTXTStringLength {
+		chunks = append(chunks, value[:maxTXTStringLength])
+		value = value[maxTXTStringLength:]
+	}
+	chunks = append(chunks, value)
+
+	quoted := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		var sb strings.Builder
+		sb.WriteString(`\"`)
+		for i := 0; i < len(chunk); i++ {
+			ch := chunk[i]
+			if ch < ' ' || ch > '~' || ch == '"' || ch == '\\' || ch == '{' || ch == '}' {
+				_, _ = fmt.Fprintf(&sb, `\%03d`, ch)
+			} else {
+				sb.WriteByte(ch)
+			}
+		}
+		sb.WriteString(`\"`)
+		quoted = append(quoted, sb.String())
+	}
+
+	return strings.Join(quoted, " ")
+}
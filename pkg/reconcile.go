@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"time"
+)
+
+// Reconciler periodically re-renders and re-saves the stored records, overwriting any edits made to the rendered
+// config by hand. The records key is the source of truth, so edits to it are rendered as-is; external-dns corrects
+// them on its next sync. Saves which wouldn't change the ConfigMap are skipped, so a tick without drift is a no-op.
+type Reconciler struct {
+	storage RecordStorage
+	leader  *LeaderElection
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewReconciler starts reconciling the storage every interval, continuing until Close is called
+// When leader is set, only the replica holding the Lease reconciles.
+func NewReconciler(storage RecordStorage, interval time.Duration, leader *LeaderElection) *Reconciler {
+	r := &Reconciler{storage: storage, leader: leader, done: make(chan struct{})}
+
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(context.Background())
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Reconcile(ctx); err != nil {
+					log.WithError(err).Warn("Reconciling ConfigMap failed")
+				}
+			}
+		}
+	}()
+	return r
+}
+
+// Reconcile re-renders the stored records, saving them if the rendered config has drifted from them
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	if r.leader != nil && !r.leader.IsLeader() {
+		return nil
+	}
+	return r.storage.Modify(ctx, func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return records, nil
+	})
+}
+
+// Close stops reconciling, waiting for any reconcile in progress to finish
+func (r *Reconciler) Close() {
+	r.cancel()
+	<-r.done
+}
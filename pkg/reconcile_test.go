@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"context"
+	"sigs.k8s.io/external-dns/endpoint"
+	"strings"
+	"testing"
+)
+
+func TestReconcileRerendersEditedConfig(t *testing.T) {
+	existing := testConfigMap(testName, map[string]string{
+		"records": marshalTestRecords(t, endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")),
+		"config":  "hand-edited",
+	})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+	r := &Reconciler{storage: s}
+
+	if err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if config := getTestConfigMap(t, client, testName).Data["config"]; !strings.Contains(config, "10.0.0.1 a.example.com") {
+		t.Fatalf("hand-edited config wasn't re-rendered: %q", config)
+	}
+
+	// Once re-rendered, a tick mustn't write again
+	waitFor(t, "the re-rendered config to be cached", func() bool {
+		cm, err := s.getConfigMap(context.Background())
+		return err == nil && strings.Contains(cm.Data["config"], "10.0.0.1 a.example.com")
+	})
+	client.ClearActions()
+	if err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if writes := countWrites(client); writes != 0 {
+		t.Errorf("got %d writes without drift, want none", writes)
+	}
+}
+
+func TestReconcileRendersEditedRecords(t *testing.T) {
+	// The records key is the source of truth, so edits to it are rendered rather than reverted;
+	// it's external-dns' next sync which corrects them
+	existing := testConfigMap(testName, map[string]string{
+		"records": marshalTestRecords(t,
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+		),
+		"config": "10.0.0.1 a.example.com",
+	})
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300}, existing)
+	r := &Reconciler{storage: s}
+
+	if err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cm := getTestConfigMap(t, client, testName)
+	if !strings.Contains(cm.Data["config"], "10.0.0.2 b.example.com") {
+		t.Errorf("edited record wasn't rendered: %q", cm.Data["config"])
+	}
+	if got := recordNames(loadTestRecords(t, s)); len(got) != 2 {
+		t.Errorf("stored %v, want the edited records kept", got)
+	}
+}
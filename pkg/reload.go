@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Rolls the configured Deployment by annotating its pod template with the config's checksum
+// CoreDNS only reloads when its Corefile changes, and mounted ConfigMaps can take a while to update,
+// so this ensures the new config is picked up promptly. Failures are logged rather than returned,
+// as the records have already been saved.
+func (s *Storage) reloadDeployment(ctx context.Context, hash string) {
+	if s.opts.ReloadDeployment == "" || hash == "" {
+		return
+	}
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]string{configHashAnnotation: hash},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.WithError(err).Warn("Could not build Deployment patch")
+		return
+	}
+	_, err = s.client().AppsV1().Deployments(s.namespace).Patch(ctx, s.opts.ReloadDeployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		log.WithError(err).Warnf("Could not reload Deployment %s/%s", s.namespace, s.opts.ReloadDeployment)
+		return
+	}
+	log.Infof("Reloading Deployment %s/%s for config %s", s.namespace, s.opts.ReloadDeployment, hash)
+}
@@ -0,0 +1,363 @@
+package pkg
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	stderrors "errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The port which CoreDNS serves DNS on by default
+const defaultListenPort = 53
+
+// Renderer turns records into a CoreDNS config, without needing access to Kubernetes
+type Renderer struct {
+	tpl  *template.Template
+	opts StorageOptions
+}
+
+// NewRenderer creates a Renderer executing the given template, as parsed by ParseConfigTemplate
+func NewRenderer(tpl *template.Template, opts StorageOptions) *Renderer {
+	if opts.TargetOrder == TargetOrderRandom && opts.TargetOrderSeed == 0 {
+		// Seed once, so that the order is stable across renders and unchanged records don't cause a save
+		opts.TargetOrderSeed = time.Now().UnixNano()
+	}
+	return &Renderer{tpl, opts}
+}
+
+// ParseConfigTemplate parses a config template, or the built-in one if text is empty
+func ParseConfigTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = configTpl
+	}
+	// Use custom delimiters for our template because the DNS responses use the standard ones
+	return template.New("config").Delims("{%", "%}").Funcs(templateFuncs).Parse(text)
+}
+
+// Render renders the config for the given records, discarding the details of any which are skipped
+func (r *Renderer) Render(records []*endpoint.Endpoint) (string, error) {
+	return r.render(context.Background(), records, &skipList{})
+}
+
+// Renders the config for the given records, noting any which are skipped
+// CNAME target lookups are bounded by ctx, as well as by CNAMELookupTimeout.
+func (r *Renderer) render(ctx context.Context, records []*endpoint.Endpoint, skipped *skipList) (string, error) {
+	standard, wildcard, templated := r.partitionRecords(records, skipped)
+
+	if r.opts.ValidateCNAMETargets {
+		r.validateCNAMETargets(ctx, templated)
+	}
+
+	data := map[string]any{
+		"standard":             standard[:],
+		"wildcard":             wildcard[:],
+		"template":             templated[:],
+		"defaultTTL":           r.opts.DefaultTTL,
+		"version":              r.opts.Version,
+		"groupBySetIdentifier": r.opts.GroupBySetIdentifier,
+		"enableReverse":        r.opts.EnableReverse,
+		"fallthroughZones":     r.opts.FallthroughZones,
+		"hostsReload":          r.opts.HostsReload,
+		"zoneOrigin":           canonicalName(r.opts.ZoneOrigin),
+	}
+	buf := bytes.Buffer{}
+
+	if err := r.tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	config := buf.String()
+	if r.opts.EmitServerBlock {
+		config = r.wrapServerBlock(config)
+	}
+	return reindent(config, r.opts.Indent), nil
+}
+
+// Wraps the config in a CoreDNS server block for the zone origin, indenting its contents
+func (r *Renderer) wrapServerBlock(config string) string {
+	zone := canonicalName(r.opts.ZoneOrigin)
+	port := r.opts.ListenPort
+	if port == 0 {
+		port = defaultListenPort
+	}
+
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "%s:%d {\n", zone, port)
+	for _, line := range strings.Split(strings.TrimRight(config, "\n"), "\n") {
+		if line != "" {
+			sb.WriteString("\t" + line)
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// Sorts and filters records for rendering, splitting them into standard (hosts), wildcard and templated records
+func (r *Renderer) partitionRecords(records []*endpoint.Endpoint, skipped *skipList) (standard, wildcard, templated []*endpoint.Endpoint) {
+	records = flattenAliases(applyProviderSpecific(records, skipped), skipped)
+
+	// Sort the records (and by default their targets), for readability and so that the output is deterministic
+	r.orderTargets(records)
+	// Higher priority records come first, as the template plugin answers with the first match
+	priorities := make(map[*endpoint.Endpoint]int, len(records))
+	for _, ep := range records {
+		priorities[ep] = recordPriority(ep)
+	}
+	slices.SortStableFunc(records, func(a, b *endpoint.Endpoint) int {
+		return cmp.Or(
+			cmp.Compare(priorities[b], priorities[a]),
+			strings.Compare(a.DNSName, b.DNSName),
+			strings.Compare(a.RecordType, b.RecordType),
+			strings.Compare(a.SetIdentifier, b.SetIdentifier),
+		)
+	})
+	records = primaryVariants(records, skipped)
+	records = r.clampTTLs(records)
+	records = r.reconcileTTLs(records)
+
+	// To simplify the template, split records into wildcard, standard (hosts) and those needing a template
+	standard = make([]*endpoint.Endpoint, 0, len(records))
+	wildcard = make([]*endpoint.Endpoint, 0, len(records))
+	templated = make([]*endpoint.Endpoint, 0, len(records))
+
+	for _, ep := range records {
+		if ep.DNSName == "" {
+			recordLog(ep).Warnf("Record (%s) has an empty DNS name. Skipping.", ep.RecordType)
+			skipped.add(ep, skipReasonEmptyName)
+			continue
+		}
+		if ep.RecordType == "SPF" {
+			recordLog(ep).Warnf("Record \"%s\" uses deprecated record type \"SPF\". Rendering as TXT.", ep.DNSName)
+			ep = ep.DeepCopy()
+			ep.RecordType = endpoint.RecordTypeTXT
+		}
+		if !isSafeName(ep.DNSName) {
+			recordLog(ep).Warnf("Record %q (%s) has a name with characters which can't be rendered safely. Skipping.", ep.DNSName, ep.RecordType)
+			skipped.add(ep, skipReasonUnsafeName)
+			continue
+		}
+		if origin := canonicalName(r.opts.ZoneOrigin); origin != "" && findZone([]string{origin}, ep.DNSName) == "" {
+			recordLog(ep).Warnf("Record \"%s\" (%s) is outside the zone origin %s, so CoreDNS wouldn't serve it. Skipping.", ep.DNSName, ep.RecordType, origin)
+			skipped.add(ep, skipReasonOutsideOrigin)
+			continue
+		}
+		if ep.RecordType == endpoint.RecordTypeNS && canonicalName(ep.DNSName) == canonicalName(r.opts.ZoneOrigin) {
+			// CoreDNS answers for the apex itself, so these may conflict with the zone's own NS records
+			recordLog(ep).Warnf("Record \"%s\" is an NS record at the zone origin, which may conflict with CoreDNS' own authority for it", ep.DNSName)
+		}
+		if slices.ContainsFunc(ep.Targets, func(target string) bool { return !isSafeTarget(ep.RecordType, target) }) {
+			recordLog(ep).Warnf("Record \"%s\" (%s) has a target with characters which can't be rendered safely. Skipping.", ep.DNSName, ep.RecordType)
+			skipped.add(ep, skipReasonUnsafeTarget)
+			continue
+		}
+		if ep.RecordType == endpoint.RecordTypeA || ep.RecordType == endpoint.RecordTypeAAAA {
+			// An invalid address would stop CoreDNS from loading the whole config
+			if ep = filterInvalidAddresses(ep, skipped); ep == nil {
+				continue
+			}
+		}
+		dest, plugin := &templated, PluginTemplate
+		if isMalformedWildcard(ep.DNSName) {
+			recordLog(ep).Warnf("Record \"%s\" (%s) is not a valid wildcard; only a leading \"*.\" is supported. Skipping.", ep.DNSName, ep.RecordType)
+			skipped.add(ep, skipReasonMalformedWildcard)
+			continue
+		} else if strings.HasPrefix(ep.DNSName, "*.") {
+			dest = &wildcard
+		} else if slices.Contains(templateOnlyRecordTypes, ep.RecordType) {
+			dest = &templated
+		} else if !isKnownRecordType(ep.RecordType) {
+			if r.opts.UnknownTypePolicy == UnknownTypeStore {
+				recordLog(ep).Warnf("Record \"%s\" uses unknown record type \"%s\". Storing, but not rendering.", ep.DNSName, ep.RecordType)
+			} else {
+				recordLog(ep).Warnf("Record \"%s\" uses unknown record type \"%s\". Skipping.", ep.DNSName, ep.RecordType)
+			}
+			skipped.add(ep, skipReasonUnknownType)
+			continue
+		} else if ep.RecordType != endpoint.RecordTypeA && ep.RecordType != endpoint.RecordTypeAAAA {
+			recordLog(ep).Warnf("Record \"%s\" uses unsupported record type \"%s\". Skipping.", ep.DNSName, ep.RecordType)
+			skipped.add(ep, skipReasonUnsupportedType)
+			continue
+		} else if ep.RecordTTL.IsConfigured() && ep.RecordTTL != r.opts.DefaultTTL {
+			// The hosts plugin applies a single TTL to all of its entries (and can only be used once),
+			// so records with their own TTL are served by a template instead
+			dest = &templated
+		} else if r.pluginAvailable(PluginHosts) {
+			dest, plugin = &standard, PluginHosts
+		}
+		if !r.pluginAvailable(plugin) {
+			recordLog(ep).Warnf("Record \"%s\" (%s) requires the %s plugin, which isn't available. Skipping.", ep.DNSName, ep.RecordType, plugin)
+			skipped.add(ep, skipReasonUnavailablePlugin)
+			continue
+		}
+		*dest = append(*dest, ep)
+	}
+
+	if r.opts.EnableReverse && len(wildcard) > 0 {
+		log.Warn("Reverse lookups are enabled, but wildcard records can't be served in reverse.")
+	}
+
+	if r.opts.GroupBySetIdentifier {
+		slices.SortStableFunc(standard, func(a, b *endpoint.Endpoint) int {
+			return strings.Compare(a.SetIdentifier, b.SetIdentifier)
+		})
+	}
+
+	return standard, wildcard, templated
+}
+
+// Returns a logger carrying the record's name and type as fields, so that structured logs can be queried by record
+func recordLog(ep *endpoint.Endpoint) *log.Entry {
+	return log.WithFields(log.Fields{"dnsName": ep.DNSName, "recordType": ep.RecordType})
+}
+
+// Whether a name uses "*" anywhere other than as a leading "*." label, e.g. "*foo.example.com" or a bare "*"
+func isMalformedWildcard(name string) bool {
+	return strings.Contains(strings.TrimPrefix(name, "*."), "*")
+}
+
+// Returns the rendering priority of a record, as set by its configmap/priority provider-specific property
+func recordPriority(ep *endpoint.Endpoint) int {
+	value, ok := ep.GetProviderSpecificProperty(providerSpecificPriority)
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		recordLog(ep).Warnf("Record \"%s\" has invalid priority \"%s\". Ignoring.", ep.DNSName, value)
+		return 0
+	}
+	return priority
+}
+
+// Drops records excluded by their configmap/exclude property and applies any configmap/ttl overrides
+func applyProviderSpecific(records []*endpoint.Endpoint, skipped *skipList) []*endpoint.Endpoint {
+	applied := make([]*endpoint.Endpoint, 0, len(records))
+	for _, ep := range records {
+		if value, ok := ep.GetProviderSpecificProperty(providerSpecificExclude); ok {
+			if exclude, err := strconv.ParseBool(value); err != nil {
+				recordLog(ep).Warnf("Record \"%s\" has invalid exclude flag \"%s\". Ignoring.", ep.DNSName, value)
+			} else if exclude {
+				recordLog(ep).Debugf("Record \"%s\" (%s) is excluded from rendering. Skipping.", ep.DNSName, ep.RecordType)
+				skipped.add(ep, skipReasonExcluded)
+				continue
+			}
+		}
+		if value, ok := ep.GetProviderSpecificProperty(providerSpecificTTL); ok {
+			if ttl, err := strconv.ParseInt(value, 10, 64); err != nil || ttl <= 0 {
+				recordLog(ep).Warnf("Record \"%s\" has invalid TTL override \"%s\". Ignoring.", ep.DNSName, value)
+			} else {
+				ep = ep.DeepCopy()
+				ep.RecordTTL = endpoint.TTL(ttl)
+			}
+		}
+		applied = append(applied, ep)
+	}
+	return applied
+}
+
+// Whether the given CoreDNS plugin can be rendered
+func (r *Renderer) pluginAvailable(plugin string) bool {
+	return len(r.opts.AvailablePlugins) == 0 || slices.Contains(r.opts.AvailablePlugins, plugin)
+}
+
+// Keeps only one set identifier's variant of each name and type, as CoreDNS has no notion of weighted,
+// geo or failover routing, and would otherwise merge or shadow the variants
+// The primary variant is the first in rendering order, i.e. that with the highest priority, or else the
+// lowest set identifier. Records must already be sorted.
+func primaryVariants(records []*endpoint.Endpoint, skipped *skipList) []*endpoint.Endpoint {
+	primary := make(map[string]string, len(records))
+	kept := make([]*endpoint.Endpoint, 0, len(records))
+	for _, ep := range records {
+		key := ep.DNSName + "/" + ep.RecordType
+		setIdentifier, seen := primary[key]
+		if !seen {
+			primary[key] = ep.SetIdentifier
+		} else if setIdentifier != ep.SetIdentifier {
+			recordLog(ep).Warnf("Record \"%s\" (%s) has multiple set identifiers. Rendering only \"%s\", skipping \"%s\".", ep.DNSName, ep.RecordType, setIdentifier, ep.SetIdentifier)
+			skipped.add(ep, skipReasonSetIdentifier)
+			continue
+		}
+		kept = append(kept, ep)
+	}
+	return kept
+}
+
+// Replaces the leading tabs of each line with the given indent
+func reindent(config, indent string) string {
+	if indent == "" || indent == "\t" {
+		return config
+	}
+	lines := strings.Split(config, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, "\t")
+		lines[i] = strings.Repeat(indent, len(line)-len(trimmed)) + trimmed
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Drops any targets of an A or AAAA record which aren't addresses of the matching family
+// Returns a copy of the record if any were dropped, or nil if none remain
+func filterInvalidAddresses(ep *endpoint.Endpoint, skipped *skipList) *endpoint.Endpoint {
+	valid := make(endpoint.Targets, 0, len(ep.Targets))
+	for _, target := range ep.Targets {
+		ip := net.ParseIP(target)
+		if ip == nil || (ip.To4() != nil) != (ep.RecordType == endpoint.RecordTypeA) {
+			recordLog(ep).Warnf("Record \"%s\" (%s) has invalid target \"%s\". Skipping the target.", ep.DNSName, ep.RecordType, target)
+			continue
+		}
+		valid = append(valid, target)
+	}
+	if len(valid) == 0 {
+		recordLog(ep).Warnf("Record \"%s\" (%s) has no valid targets. Skipping.", ep.DNSName, ep.RecordType)
+		skipped.add(ep, skipReasonInvalidTargets)
+		return nil
+	}
+	if len(valid) < len(ep.Targets) {
+		ep = ep.DeepCopy()
+		ep.Targets = valid
+	}
+	return ep
+}
+
+// Best-effort check that the CNAMEs' targets resolve, to catch typos before they're published
+// Saves wait for the lookups, so they're made in parallel rather than each adding to the time taken.
+func (r *Renderer) validateCNAMETargets(ctx context.Context, records []*endpoint.Endpoint) {
+	var wg sync.WaitGroup
+	for _, ep := range records {
+		if ep.RecordType != endpoint.RecordTypeCNAME {
+			continue
+		}
+		for _, target := range ep.Targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.validateCNAMETarget(ctx, ep, target)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (r *Renderer) validateCNAMETarget(ctx context.Context, ep *endpoint.Endpoint, target string) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.CNAMELookupTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(ctx, target)
+
+	var dnsErr *net.DNSError
+	if stderrors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		recordLog(ep).Warnf("Record \"%s\" has CNAME target \"%s\" which does not resolve", ep.DNSName, target)
+	} else if err != nil {
+		log.WithError(err).Debugf("Could not validate CNAME target \"%s\" of record \"%s\"", target, ep.DNSName)
+	}
+}
@@ -0,0 +1,622 @@
+package pkg
+
+import (
+	"context"
+	stderrors "errors"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"net"
+	"regexp"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Renders the records with the built-in template, failing the test on error
+func renderTest(t *testing.T, opts StorageOptions, records ...*endpoint.Endpoint) string {
+	t.Helper()
+	tpl, err := ParseConfigTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.DefaultTTL == 0 {
+		opts.DefaultTTL = 300
+	}
+	config, err := NewRenderer(tpl, opts).Render(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// Fails the test unless the config contains each of the given lines, ignoring indentation
+func assertContainsLines(t *testing.T, config string, lines ...string) {
+	t.Helper()
+	trimmed := map[string]bool{}
+	for _, line := range strings.Split(config, "\n") {
+		trimmed[strings.TrimSpace(line)] = true
+	}
+	for _, line := range lines {
+		if !trimmed[line] {
+			t.Errorf("config is missing line %q:\n%s", line, config)
+		}
+	}
+}
+
+// Fails the test if the config contains the given text
+func assertNotContains(t *testing.T, config, text string) {
+	t.Helper()
+	if strings.Contains(config, text) {
+		t.Errorf("config unexpectedly contains %q:\n%s", text, config)
+	}
+}
+
+// Returns the messages of the warnings logged while running fn
+func captureWarnings(fn func()) []string {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	fn()
+
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	return warnings
+}
+
+func TestRenderCNAMEAnswersAllQueryTypes(t *testing.T) {
+	config := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "web.example.net"),
+		endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeCNAME, "ingress.example.net"),
+	)
+	assertContainsLines(t, config,
+		"template IN ANY www.example.com {",
+		`answer "{{ .Name }} 300 IN CNAME web.example.net."`,
+		"template IN ANY apps.example.com {",
+		`answer "{{ .Name }} 300 IN CNAME ingress.example.net."`,
+	)
+	assertNotContains(t, config, "template IN CNAME")
+}
+
+func TestRenderServerBlock(t *testing.T) {
+	records := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+	}
+
+	config := renderTest(t, StorageOptions{ZoneOrigin: "example.com.", EmitServerBlock: true, ListenPort: 1053}, records...)
+	lines := strings.Split(strings.TrimRight(config, "\n"), "\n")
+	if lines[0] != "example.com:1053 {" {
+		t.Errorf("first line is %q, want the server block header", lines[0])
+	}
+	if last := lines[len(lines)-1]; last != "}" {
+		t.Errorf("last line is %q, want the closing brace", last)
+	}
+	assertContainsLines(t, config, "10.0.0.1 a.example.com")
+
+	fragment := renderTest(t, StorageOptions{ZoneOrigin: "example.com"}, records...)
+	assertNotContains(t, fragment, "example.com:53")
+}
+
+func TestCNAMEValidationStopsWithContext(t *testing.T) {
+	tpl, err := ParseConfigTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRenderer(tpl, StorageOptions{DefaultTTL: 300, ValidateCNAMETargets: true, CNAMELookupTimeout: time.Minute})
+	records := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "a.example.invalid"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeCNAME, "b.example.invalid"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err := r.render(ctx, records, &skipList{}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("render took %s after its context was cancelled", elapsed)
+	}
+}
+
+func TestRenderSPFAsTXT(t *testing.T) {
+	config := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("spf.example.com", "SPF", "v=spf1 -all"),
+	)
+	assertContainsLines(t, config,
+		"template IN TXT spf.example.com {",
+		`answer "{{ .Name }} 300 IN TXT \"v=spf1 -all\""`,
+	)
+	assertNotContains(t, config, "SPF")
+}
+
+func TestRenderVersionHeader(t *testing.T) {
+	config := renderTest(t, StorageOptions{Version: "1.2.3"})
+	if want := "# Generated by external-dns-configmap-provider v1.2.3\n"; !strings.HasPrefix(config, want) {
+		t.Errorf("config doesn't start with %q:\n%s", want, config)
+	}
+}
+
+func TestRenderWildcardAdditionalTargets(t *testing.T) {
+	single := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+	)
+	assertContainsLines(t, single, `answer "{{ .Name }} 300 IN A 10.0.0.1"`)
+	assertNotContains(t, single, "additional")
+
+	multiple := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeA, "10.0.0.1", "10.0.0.2", "10.0.0.3"),
+	)
+	assertContainsLines(t, multiple,
+		`answer "{{ .Name }} 300 IN A 10.0.0.1"`,
+		`additional "{{ .Name }} 300 IN A 10.0.0.2"`,
+		`additional "{{ .Name }} 300 IN A 10.0.0.3"`,
+	)
+}
+
+func TestCNAMEValidationWarnsOnUnresolvableTargets(t *testing.T) {
+	// RFC 6761 guarantees that .invalid names don't resolve, but not that we can reach a resolver to ask
+	var dnsErr *net.DNSError
+	if _, err := net.DefaultResolver.LookupHost(context.Background(), "unresolvable.invalid"); !stderrors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Skipf("no resolver to validate against: %v", err)
+	}
+
+	warnings := captureWarnings(func() {
+		renderTest(t, StorageOptions{ValidateCNAMETargets: true, CNAMELookupTimeout: 5 * time.Second},
+			endpoint.NewEndpoint("good.example.com", endpoint.RecordTypeCNAME, "localhost"),
+			endpoint.NewEndpoint("bad.example.com", endpoint.RecordTypeCNAME, "unresolvable.invalid"),
+		)
+	})
+	want := `Record "bad.example.com" has CNAME target "unresolvable.invalid" which does not resolve`
+	if !slices.Equal(warnings, []string{want}) {
+		t.Errorf("got warnings %q, want only %q", warnings, want)
+	}
+}
+
+func TestRenderApexAlongsideWildcard(t *testing.T) {
+	config := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("*.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+	)
+	assertContainsLines(t, config,
+		"10.0.0.1 example.com",
+		"template IN A example.com {",
+		`match "^.+\.example\.com\.$"`,
+		`answer "{{ .Name }} 300 IN A 10.0.0.2"`,
+	)
+	// The wildcard's pattern must require a label before the apex, so that it can't shadow it
+	pattern := regexp.MustCompile(matchSubdomainRegex("example.com"))
+	if pattern.MatchString("example.com.") {
+		t.Error("wildcard pattern matches the apex")
+	}
+	if !pattern.MatchString("www.example.com.") {
+		t.Error("wildcard pattern doesn't match a subdomain")
+	}
+}
+
+func TestRenderGroupedBySetIdentifier(t *testing.T) {
+	records := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1").WithSetIdentifier("blue"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2").WithSetIdentifier("green"),
+	}
+
+	grouped := renderTest(t, StorageOptions{GroupBySetIdentifier: true}, records...)
+	blue := strings.Index(grouped, "# Set identifier: blue")
+	green := strings.Index(grouped, "# Set identifier: green")
+	a := strings.Index(grouped, "10.0.0.1 a.example.com")
+	b := strings.Index(grouped, "10.0.0.2 b.example.com")
+	if blue < 0 || green < 0 || !(blue < a && a < green && green < b) {
+		t.Errorf("records aren't in labelled groups:\n%s", grouped)
+	}
+
+	merged := renderTest(t, StorageOptions{}, records...)
+	assertContainsLines(t, merged, "10.0.0.1 a.example.com", "10.0.0.2 b.example.com")
+	assertNotContains(t, merged, "Set identifier")
+}
+
+func TestRenderIndent(t *testing.T) {
+	records := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("*.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+	}
+	config := renderTest(t, StorageOptions{Indent: "  "}, records...)
+	if strings.Contains(config, "\t") {
+		t.Errorf("config still contains tabs:\n%s", config)
+	}
+	for _, want := range []string{"\n  10.0.0.1 a.example.com\n", "\n  ttl 300\n", "\n  match \"^.+\\.example\\.com\\.$\"\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config doesn't contain %q:\n%s", want, config)
+		}
+	}
+
+	nested := renderTest(t, StorageOptions{Indent: "  ", ZoneOrigin: "example.com", EmitServerBlock: true}, records...)
+	assertContainsLines(t, nested, "10.0.0.1 a.example.com")
+	if !strings.Contains(nested, "\n    10.0.0.1 a.example.com\n") {
+		t.Errorf("server block contents aren't indented twice:\n%s", nested)
+	}
+}
+
+func TestRenderAllTargets(t *testing.T) {
+	records := func(targets ...string) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{endpoint.NewEndpoint("multi.example.com", endpoint.RecordTypeA, targets...)}
+	}
+	config := renderTest(t, StorageOptions{}, records("10.0.0.3", "10.0.0.1", "10.0.0.2")...)
+	assertContainsLines(t, config,
+		"10.0.0.1 multi.example.com",
+		"10.0.0.2 multi.example.com",
+		"10.0.0.3 multi.example.com",
+	)
+	if again := renderTest(t, StorageOptions{}, records("10.0.0.2", "10.0.0.3", "10.0.0.1")...); again != config {
+		t.Errorf("config depends on the targets' order:\n%s\nthen:\n%s", config, again)
+	}
+}
+
+func TestRenderWithoutTemplatePlugin(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{AvailablePlugins: []string{PluginHosts}},
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+		)
+	})
+	assertContainsLines(t, config, "10.0.0.1 a.example.com")
+	assertNotContains(t, config, "template")
+	want := `Record "*.apps.example.com" (A) requires the template plugin, which isn't available. Skipping.`
+	if !slices.Contains(warnings, want) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestRenderAAAA(t *testing.T) {
+	config := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("v6.example.com", endpoint.RecordTypeAAAA, "2001:db8::1"),
+	)
+	assertContainsLines(t, config, "2001:db8::1 v6.example.com")
+}
+
+func TestRenderPriority(t *testing.T) {
+	broad := endpoint.NewEndpoint("*.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	narrow := endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeA, "10.0.0.2")
+	tests := []struct {
+		name      string
+		priority  string
+		wantFirst string
+	}{
+		{"by name without priorities", "", "10.0.0.2"},
+		{"higher priority first", "10", "10.0.0.1"},
+		{"invalid priority ignored", "high", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prioritized := broad.DeepCopy()
+			if tt.priority != "" {
+				prioritized = prioritized.WithProviderSpecific(providerSpecificPriority, tt.priority)
+			}
+			config := renderTest(t, StorageOptions{}, prioritized, narrow)
+			first, second := "10.0.0.1", "10.0.0.2"
+			if tt.wantFirst == second {
+				first, second = second, first
+			}
+			if strings.Index(config, first) > strings.Index(config, second) {
+				t.Errorf("%s isn't rendered before %s:\n%s", first, second, config)
+			}
+		})
+	}
+}
+
+func TestRenderSkipsEmptyNames(t *testing.T) {
+	config := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("", endpoint.RecordTypeCNAME, "target.example.com"),
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+	)
+	assertContainsLines(t, config, "10.0.0.2 a.example.com")
+	assertNotContains(t, config, "10.0.0.1")
+	assertNotContains(t, config, "target.example.com")
+}
+
+func TestRenderSkipsInvalidAddresses(t *testing.T) {
+	var skipped skipList
+	tpl, err := ParseConfigTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewRenderer(tpl, StorageOptions{DefaultTTL: 300}).render(context.Background(), []*endpoint.Endpoint{
+		endpoint.NewEndpoint("bogus.example.com", endpoint.RecordTypeA, "not-an-ip"),
+		endpoint.NewEndpoint("hostname.example.com", endpoint.RecordTypeA, "web.example.com"),
+		endpoint.NewEndpoint("family.example.com", endpoint.RecordTypeAAAA, "10.0.0.1"),
+		endpoint.NewEndpoint("partial.example.com", endpoint.RecordTypeA, "10.0.0.2", "not-an-ip"),
+	}, &skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertContainsLines(t, config, "10.0.0.2 partial.example.com")
+	for _, text := range []string{"not-an-ip", "web.example.com", "10.0.0.1", "bogus.example.com", "family.example.com"} {
+		assertNotContains(t, config, text)
+	}
+	var names []string
+	for _, record := range skipped {
+		if record.Reason == skipReasonInvalidTargets {
+			names = append(names, record.DNSName)
+		}
+	}
+	if want := []string{"bogus.example.com", "family.example.com", "hostname.example.com"}; !slices.Equal(names, want) {
+		t.Errorf("skipped %v for invalid targets, want %v", names, want)
+	}
+}
+
+func TestRenderSRV(t *testing.T) {
+	config := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("_sip._tcp.example.com", endpoint.RecordTypeSRV, "10 60 5060 sipserver.example.com", "20 40 5060 backup.example.com."),
+	)
+	assertContainsLines(t, config,
+		"template IN SRV _sip._tcp.example.com {",
+		`match "^_sip\._tcp\.example\.com\.$"`,
+		`answer "{{ .Name }} 300 IN SRV 10 60 5060 sipserver.example.com."`,
+		`answer "{{ .Name }} 300 IN SRV 20 40 5060 backup.example.com."`,
+	)
+}
+
+func TestRenderMX(t *testing.T) {
+	config := renderTest(t, StorageOptions{TargetOrder: TargetOrderSource},
+		endpoint.NewEndpoint("example.com", endpoint.RecordTypeMX, "20 mx2.example.com", "10 mx1.example.com"),
+	)
+	first := `answer "{{ .Name }} 300 IN MX 20 mx2.example.com."`
+	second := `answer "{{ .Name }} 300 IN MX 10 mx1.example.com."`
+	assertContainsLines(t, config, "template IN MX example.com {", first, second)
+	if strings.Index(config, first) > strings.Index(config, second) {
+		t.Errorf("targets weren't kept in their original order:\n%s", config)
+	}
+}
+
+func TestRenderWildcards(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{},
+			endpoint.NewEndpoint("*.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("*.a.b.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+			endpoint.NewEndpoint("*foo.example.com", endpoint.RecordTypeA, "10.0.0.3"),
+		)
+	})
+	assertContainsLines(t, config,
+		"template IN A example.com {",
+		`match "^.+\.example\.com\.$"`,
+		"template IN A a.b.example.com {",
+		`match "^.+\.a\.b\.example\.com\.$"`,
+	)
+	assertNotContains(t, config, "10.0.0.3")
+	want := `Record "*foo.example.com" (A) is not a valid wildcard; only a leading "*." is supported. Skipping.`
+	if !slices.Contains(warnings, want) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestRenderOneSetIdentifierPerName(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{},
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.2").WithSetIdentifier("west"),
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.1").WithSetIdentifier("east"),
+		)
+	})
+	assertContainsLines(t, config, "10.0.0.1 www.example.com")
+	assertNotContains(t, config, "10.0.0.2")
+	want := `Record "www.example.com" (A) has multiple set identifiers. Rendering only "east", skipping "west".`
+	if !slices.Equal(warnings, []string{want}) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestRenderWildcardTargetsDeterministically(t *testing.T) {
+	first := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeA, "10.0.0.2", "10.0.0.1", "10.0.0.3"),
+	)
+	second := renderTest(t, StorageOptions{},
+		endpoint.NewEndpoint("*.apps.example.com", endpoint.RecordTypeA, "10.0.0.3", "10.0.0.2", "10.0.0.1"),
+	)
+	if first != second {
+		t.Errorf("config depends on the targets' order:\n%s\nthen:\n%s", first, second)
+	}
+	assertContainsLines(t, first, `answer "{{ .Name }} 300 IN A 10.0.0.1"`)
+}
+
+func TestRenderSkipsUnsafeNamesAndTargets(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{},
+			endpoint.NewEndpoint("evil.example.com\n}\nforward . 1.2.3.4", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("txt.example.com", endpoint.RecordTypeTXT, "value\" }\nforward . 1.2.3.4 {"),
+			endpoint.NewEndpoint("cname.example.com", endpoint.RecordTypeCNAME, "target}.example.com"),
+			endpoint.NewEndpoint("safe.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+		)
+	})
+	// TXT values are escaped rather than skipped, so can't break out of their answer
+	assertContainsLines(t, config,
+		"10.0.0.2 safe.example.com",
+		`answer "{{ .Name }} 300 IN TXT \"value\034 \125\010forward . 1.2.3.4 \123\""`,
+	)
+	assertNotContains(t, config, "evil")
+	assertNotContains(t, config, "target}")
+	for _, line := range strings.Split(config, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "forward") {
+			t.Errorf("config contains an injected directive:\n%s", config)
+		}
+	}
+	if len(warnings) != 2 {
+		t.Errorf("got warnings %q, want one per skipped record", warnings)
+	}
+}
+
+func TestRenderFallthroughZones(t *testing.T) {
+	record := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")
+
+	scoped := renderTest(t, StorageOptions{FallthroughZones: []string{"example.com", "example.org"}}, record)
+	assertContainsLines(t, scoped, "fallthrough example.com example.org")
+
+	unscoped := renderTest(t, StorageOptions{}, record)
+	assertContainsLines(t, unscoped, "fallthrough")
+	assertNotContains(t, unscoped, "fallthrough example.com")
+}
+
+func TestRenderZoneOrigin(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{ZoneOrigin: "example.com."},
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("txt.example.com", endpoint.RecordTypeTXT, "inside"),
+			endpoint.NewEndpoint("b.example.org", endpoint.RecordTypeA, "10.0.0.2"),
+		)
+	})
+	assertContainsLines(t, config,
+		"10.0.0.1 a.example.com",
+		// Template blocks are scoped to the origin, with the record matched by name
+		"template IN TXT example.com {",
+		`match "^txt\.example\.com\.$"`,
+	)
+	assertNotContains(t, config, "example.org")
+	want := `Record "b.example.org" (A) is outside the zone origin example.com, so CoreDNS wouldn't serve it. Skipping.`
+	if !slices.Equal(warnings, []string{want}) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    StorageOptions
+		records []*endpoint.Endpoint
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "A",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+			want:    []string{"10.0.0.1 a.example.com", "ttl 300"},
+		},
+		{
+			name:    "AAAA",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeAAAA, "2001:db8::1")},
+			want:    []string{"2001:db8::1 a.example.com"},
+		},
+		{
+			name:    "CNAME",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "web.example.net")},
+			want:    []string{"template IN ANY www.example.com {", `answer "{{ .Name }} 300 IN CNAME web.example.net."`},
+		},
+		{
+			name:    "TXT",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("txt.example.com", endpoint.RecordTypeTXT, "hello world")},
+			want:    []string{"template IN TXT txt.example.com {", `answer "{{ .Name }} 300 IN TXT \"hello world\""`},
+		},
+		{
+			name:    "SRV",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("_sip._tcp.example.com", endpoint.RecordTypeSRV, "10 60 5060 sip.example.com")},
+			want:    []string{`answer "{{ .Name }} 300 IN SRV 10 60 5060 sip.example.com."`},
+		},
+		{
+			name:    "MX",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("example.com", endpoint.RecordTypeMX, "10 mx.example.com")},
+			want:    []string{`answer "{{ .Name }} 300 IN MX 10 mx.example.com."`},
+		},
+		{
+			name:    "NS",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("sub.example.com", endpoint.RecordTypeNS, "ns1.example.net")},
+			want:    []string{"template IN NS sub.example.com {", `answer "{{ .Name }} 300 IN NS ns1.example.net."`},
+		},
+		{
+			name:    "unsupported type",
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("1.0.0.10.in-addr.arpa", endpoint.RecordTypePTR, "a.example.com")},
+			notWant: []string{"in-addr.arpa"},
+		},
+		{
+			name:    "default TTL",
+			opts:    StorageOptions{DefaultTTL: 60},
+			records: []*endpoint.Endpoint{endpoint.NewEndpoint("txt.example.com", endpoint.RecordTypeTXT, "hello")},
+			want:    []string{`answer "{{ .Name }} 60 IN TXT \"hello\""`},
+		},
+		{
+			name:    "record TTL",
+			records: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("a.example.com", endpoint.RecordTypeA, 30, "10.0.0.1")},
+			want:    []string{"template IN A a.example.com {", `answer "{{ .Name }} 30 IN A 10.0.0.1"`},
+			notWant: []string{"10.0.0.1 a.example.com"},
+		},
+		{
+			name:    "record TTL matching the default",
+			records: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("a.example.com", endpoint.RecordTypeA, 300, "10.0.0.1")},
+			want:    []string{"10.0.0.1 a.example.com"},
+		},
+		{
+			name: "TTL property",
+			records: []*endpoint.Endpoint{
+				endpoint.NewEndpointWithTTL("a.example.com", endpoint.RecordTypeA, 30, "10.0.0.1").WithProviderSpecific(providerSpecificTTL, "90"),
+			},
+			want: []string{`answer "{{ .Name }} 90 IN A 10.0.0.1"`},
+		},
+		{
+			name: "excluded",
+			records: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1").WithProviderSpecific(providerSpecificExclude, "true"),
+			},
+			notWant: []string{"a.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := renderTest(t, tt.opts, tt.records...)
+			assertContainsLines(t, config, tt.want...)
+			for _, text := range tt.notWant {
+				assertNotContains(t, config, text)
+			}
+		})
+	}
+}
+
+func TestRenderNSDelegation(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{ZoneOrigin: "example.com"},
+			endpoint.NewEndpoint("sub.example.com", endpoint.RecordTypeNS, "ns1.example.net", "ns2.example.net."))
+	})
+	assertContainsLines(t, config,
+		"template IN NS example.com {",
+		`match "^sub\.example\.com\.$"`,
+		`answer "{{ .Name }} 300 IN NS ns1.example.net."`,
+		`answer "{{ .Name }} 300 IN NS ns2.example.net."`,
+	)
+	assertNotContains(t, config, "ns2.example.net..")
+	if len(warnings) != 0 {
+		t.Errorf("delegation was warned about: %v", warnings)
+	}
+}
+
+func TestRenderApexNSWarns(t *testing.T) {
+	var config string
+	warnings := captureWarnings(func() {
+		config = renderTest(t, StorageOptions{ZoneOrigin: "example.com"},
+			endpoint.NewEndpoint("example.com", endpoint.RecordTypeNS, "ns1.example.net"))
+	})
+	assertContainsLines(t, config, `answer "{{ .Name }} 300 IN NS ns1.example.net."`)
+	want := `Record "example.com" is an NS record at the zone origin, which may conflict with CoreDNS' own authority for it`
+	if !slices.Contains(warnings, want) {
+		t.Errorf("got warnings %v, want %q", warnings, want)
+	}
+}
+
+func TestRenderFlattensApexAlias(t *testing.T) {
+	config := renderTest(t, StorageOptions{ZoneOrigin: "example.com"},
+		endpoint.NewEndpoint("example.com", endpoint.RecordTypeCNAME, "lb.example.com").WithProviderSpecific(providerSpecificAlias, "true"),
+		endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeA, "10.0.0.1", "10.0.0.2"),
+		endpoint.NewEndpoint("lb.example.com", endpoint.RecordTypeAAAA, "2001:db8::1"),
+	)
+	assertContainsLines(t, config,
+		"10.0.0.1 example.com",
+		"10.0.0.2 example.com",
+		"2001:db8::1 example.com",
+	)
+	assertNotContains(t, config, "CNAME")
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"strings"
+)
+
+// Characters, besides letters and digits, which may appear in names and targets written into the config
+// Anything else could be significant to the Corefile (e.g. braces, quotes or newlines) and break or inject into it.
+const (
+	safeNameChars   = "-_.*"
+	safeTargetChars = "-_.*: "
+)
+
+// Whether a name can be written into the config as-is
+func isSafeName(name string) bool {
+	return hasOnlySafeChars(name, safeNameChars)
+}
+
+// Whether a target can be written into the config as-is
+// TXT targets are always safe, as they're escaped when rendered.
+func isSafeTarget(recordType, target string) bool {
+	return recordType == endpoint.RecordTypeTXT || hasOnlySafeChars(target, safeTargetChars)
+}
+
+func hasOnlySafeChars(s, extra string) bool {
+	for _, ch := range s {
+		if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || strings.ContainsRune(extra, ch)) {
+			return false
+		}
+	}
+	return true
+}
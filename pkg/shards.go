@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+)
+
+// A Storage holding only the records at or under a domain suffix
+type Shard struct {
+	Storage *Storage
+	// Suffix selects the records routed to this shard; empty for the catch-all
+	Suffix string
+}
+
+// ShardedStorage spreads records across several ConfigMaps by domain suffix, presenting them as one
+// Records are routed to the shard with the most specific matching suffix, or else to the catch-all.
+type ShardedStorage struct {
+	shards   []Shard
+	suffixes []string
+	catchAll int
+}
+
+// NewShardedStorage combines the given shards, routing records which match no suffix to the one without a suffix,
+// or to the first if they all have one
+func NewShardedStorage(shards []Shard) *ShardedStorage {
+	ss := &ShardedStorage{shards: shards, suffixes: make([]string, len(shards))}
+	for i, shard := range shards {
+		ss.suffixes[i] = canonicalName(shard.Suffix)
+		if shard.Suffix == "" {
+			ss.catchAll = i
+		}
+	}
+
+	// Move any records stored in the wrong shard, e.g. after adding a shard
+	// Only the leader may write, so with leader election this waits until we're elected.
+	if leader := shards[0].Storage.opts.Leader; leader != nil {
+		leader.OnStartedLeading(ss.reroute)
+	} else {
+		ss.reroute()
+	}
+
+	return ss
+}
+
+// Moves any records stored in the wrong shard to the right one
+func (ss *ShardedStorage) reroute() {
+	if err := ss.Modify(context.Background(), func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		return records, nil
+	}); err != nil {
+		log.WithError(err).Warn("Could not route records between shards")
+	}
+}
+
+// Returns the index of the shard which the given name belongs to
+func (ss *ShardedStorage) shardFor(name string) int {
+	if zone := findZone(ss.suffixes, name); zone != "" {
+		return slices.Index(ss.suffixes, zone)
+	}
+	return ss.catchAll
+}
+
+// Splits records between the shards
+func (ss *ShardedStorage) route(records []*endpoint.Endpoint) [][]*endpoint.Endpoint {
+	routed := make([][]*endpoint.Endpoint, len(ss.shards))
+	for i := range routed {
+		routed[i] = []*endpoint.Endpoint{}
+	}
+	for _, ep := range records {
+		i := ss.shardFor(ep.DNSName)
+		routed[i] = append(routed[i], ep)
+	}
+	return routed
+}
+
+// Load returns the records of every shard
+func (ss *ShardedStorage) Load(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return ss.load(ctx, false)
+}
+
+// Reads the records of every shard, bypassing their caches when live is set
+func (ss *ShardedStorage) load(ctx context.Context, live bool) ([]*endpoint.Endpoint, error) {
+	var records []*endpoint.Endpoint
+	for _, shard := range ss.shards {
+		shardRecords, err := shard.Storage.load(ctx, live)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Loading ConfigMap %s failed", shard.Storage.name)
+		}
+		records = append(records, shardRecords...)
+	}
+	return records, nil
+}
+
+// Modify loads the records of every shard, applies fn to them and saves each shard's share of the result
+// All shards are locked for the duration, but the saves aren't atomic; a failure may leave earlier shards updated.
+// As with Storage.Modify, a conflict retries the whole sequence, so fn may be called more than once.
+func (ss *ShardedStorage) Modify(ctx context.Context, fn func([]*endpoint.Endpoint) ([]*endpoint.Endpoint, error)) error {
+	for _, shard := range ss.shards {
+		shard.Storage.state.modifying.Lock()
+		defer shard.Storage.state.modifying.Unlock()
+	}
+
+	live := false
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		defer func() { live = true }()
+
+		records, err := ss.load(ctx, live)
+		if err != nil {
+			return err
+		}
+		if records, err = fn(records); err != nil {
+			return err
+		}
+		for i, shardRecords := range ss.route(records) {
+			if err := ss.shards[i].Storage.store(ctx, shardRecords, live); err != nil {
+				return errors.Wrapf(err, "Saving ConfigMap %s failed", ss.shards[i].Storage.name)
+			}
+		}
+		return nil
+	})
+}
+
+// SupportedRecordTypes lists the record types which will be rendered
+func (ss *ShardedStorage) SupportedRecordTypes() []string {
+	return ss.shards[0].Storage.SupportedRecordTypes()
+}
+
+// Features reports which optional storage behaviours are enabled
+func (ss *ShardedStorage) Features() map[string]bool {
+	features := ss.shards[0].Storage.Features()
+	features["sharded"] = true
+	return features
+}
+
+// Ready returns an error if any shard isn't yet usable
+func (ss *ShardedStorage) Ready() error {
+	for _, shard := range ss.shards {
+		if err := shard.Storage.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status summarizes the records of every shard, reporting the most recent save of any
+func (ss *ShardedStorage) Status() StorageStatus {
+	status := StorageStatus{Records: map[string]int{}}
+	for _, shard := range ss.shards {
+		shardStatus := shard.Storage.Status()
+		for recordType, count := range shardStatus.Records {
+			status.Records[recordType] += count
+		}
+		if shardStatus.LastSave != nil && (status.LastSave == nil || shardStatus.LastSave.After(*status.LastSave)) {
+			status.LastSave = shardStatus.LastSave
+		}
+	}
+	return status
+}
+
+// Skipped lists the records which were left out of each shard's most recently rendered config
+func (ss *ShardedStorage) Skipped() []SkippedRecord {
+	skipped := []SkippedRecord{}
+	for _, shard := range ss.shards {
+		skipped = append(skipped, shard.Storage.Skipped()...)
+	}
+	return skipped
+}
+
+// MarkSeen notes that external-dns still wants the given records, in the shards they belong to
+func (ss *ShardedStorage) MarkSeen(records []*endpoint.Endpoint) {
+	for i, shardRecords := range ss.route(records) {
+		ss.shards[i].Storage.MarkSeen(shardRecords)
+	}
+}
+
+// RenderedRecords returns the records as they would be rendered by their shards
+func (ss *ShardedStorage) RenderedRecords(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+	var rendered []*endpoint.Endpoint
+	for i, shardRecords := range ss.route(records) {
+		rendered = append(rendered, ss.shards[i].Storage.RenderedRecords(shardRecords)...)
+	}
+	return rendered
+}
+
+// Close releases every shard
+func (ss *ShardedStorage) Close(ctx context.Context) error {
+	var errs []error
+	for _, shard := range ss.shards {
+		if err := shard.Storage.Close(ctx); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Releasing ConfigMap %s failed", shard.Storage.name))
+		}
+	}
+	return stderrors.Join(errs...)
+}
+
+func (ss *ShardedStorage) unknownTypePolicy() UnknownTypePolicy {
+	return ss.shards[0].Storage.unknownTypePolicy()
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"testing"
+)
+
+// Creates a ShardedStorage over ConfigMaps named after their suffixes, with "default" as the catch-all
+func newTestShardedStorage(t *testing.T, suffixes []string, objects ...runtime.Object) (*ShardedStorage, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	shards := make([]Shard, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		name := suffix
+		if name == "" {
+			name = "default"
+		}
+		shards = append(shards, Shard{newStorage(name, testNamespace, client, StorageOptions{DefaultTTL: 300}), suffix})
+	}
+	ss := NewShardedStorage(shards)
+	t.Cleanup(func() {
+		_ = ss.Close(context.Background())
+	})
+	return ss, client
+}
+
+// Decodes the records stored in the named ConfigMap
+func shardRecordNames(t *testing.T, client *fake.Clientset, name string) []string {
+	t.Helper()
+	var records []*endpoint.Endpoint
+	if err := json.Unmarshal([]byte(getTestConfigMap(t, client, name).Data["records"]), &records); err != nil {
+		t.Fatal(err)
+	}
+	return recordNames(records)
+}
+
+func TestShardsRouteByZone(t *testing.T) {
+	ss, client := newTestShardedStorage(t, []string{"example.com", "example.org", ""})
+	modifyTestRecords(t, ss, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("b.example.org", endpoint.RecordTypeA, "10.0.0.2"),
+			endpoint.NewEndpoint("c.example.net", endpoint.RecordTypeA, "10.0.0.3"),
+		}
+	})
+
+	for name, want := range map[string][]string{
+		"example.com": {"a.example.com"},
+		"example.org": {"b.example.org"},
+		"default":     {"c.example.net"},
+	} {
+		if got := shardRecordNames(t, client, name); !slices.Equal(got, want) {
+			t.Errorf("ConfigMap %s holds %v, want %v", name, got, want)
+		}
+	}
+	if got := recordNames(loadTestRecords(t, ss)); len(got) != 3 {
+		t.Errorf("loaded %v, want the records of every shard", got)
+	}
+}
+
+func TestShardsRerouteMisplacedRecords(t *testing.T) {
+	misplaced := testConfigMap("default", map[string]string{"records": marshalTestRecords(t,
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("c.example.net", endpoint.RecordTypeA, "10.0.0.3"),
+	)})
+	_, client := newTestShardedStorage(t, []string{"example.com", ""}, misplaced)
+
+	if got := shardRecordNames(t, client, "example.com"); !slices.Equal(got, []string{"a.example.com"}) {
+		t.Errorf("example.com shard holds %v, want the misplaced record", got)
+	}
+	if got := shardRecordNames(t, client, "default"); !slices.Equal(got, []string{"c.example.net"}) {
+		t.Errorf("catch-all holds %v, want only its own record", got)
+	}
+}
+
+func TestShardsStoredRecordsMetric(t *testing.T) {
+	ss, _ := newTestShardedStorage(t, []string{"example.com", ""})
+	modifyTestRecords(t, ss, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+			endpoint.NewEndpoint("c.example.net", endpoint.RecordTypeA, "10.0.0.3"),
+			endpoint.NewEndpoint("c.example.net", endpoint.RecordTypeTXT, "hello"),
+		}
+	})
+
+	tests := []struct {
+		configMap, recordType string
+		want                  float64
+	}{
+		{testNamespace + "/example.com", endpoint.RecordTypeA, 2},
+		{testNamespace + "/example.com", endpoint.RecordTypeTXT, 0},
+		{testNamespace + "/default", endpoint.RecordTypeA, 1},
+		{testNamespace + "/default", endpoint.RecordTypeTXT, 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(storedRecords.WithLabelValues(tt.configMap, tt.recordType)); got != tt.want {
+			t.Errorf("got %v %s records stored in %s, want %v", got, tt.recordType, tt.configMap, tt.want)
+		}
+	}
+}
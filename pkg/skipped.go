@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+)
+
+// SkippedRecord is a record which was left out of the rendered config, as returned by GET /skipped
+type SkippedRecord struct {
+	DNSName    string `json:"dnsName"`
+	RecordType string `json:"recordType"`
+	// Reason is why the record was skipped, as in the reason label of the records_skipped_total metric
+	Reason string `json:"reason"`
+}
+
+// Collects the records skipped while rendering
+type skipList []SkippedRecord
+
+func (l *skipList) add(ep *endpoint.Endpoint, reason string) {
+	*l = append(*l, SkippedRecord{ep.DNSName, ep.RecordType, reason})
+}
+
+// Counts the records skipped by a render, and keeps them for Skipped
+func (s *Storage) rememberSkipped(skipped skipList) {
+	for _, record := range skipped {
+		recordsSkipped.WithLabelValues(record.RecordType, record.Reason).Inc()
+	}
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	s.state.skipped = skipped
+}
+
+// Skipped lists the records which were left out of the most recently rendered config, and why
+func (s *Storage) Skipped() []SkippedRecord {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	if s.state.skipped == nil {
+		return []SkippedRecord{}
+	}
+	return slices.Clone(s.state.skipped)
+}
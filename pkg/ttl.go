@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// How to render records which share a name and type, but disagree on their TTL
+type TTLConflictStrategy string
+
+const (
+	// Warn, and use the lowest of the TTLs for all of the records
+	TTLConflictLowest TTLConflictStrategy = "lowest"
+	// Keep each record's own TTL, rendering those which differ from the default TTL in their own template blocks
+	// CoreDNS answers from only one of the blocks, so the records' targets aren't combined into one answer.
+	TTLConflictSplit TTLConflictStrategy = "split"
+)
+
+// TTLConflictStrategies lists the strategies which can be selected
+var TTLConflictStrategies = []TTLConflictStrategy{TTLConflictLowest, TTLConflictSplit}
+
+// Clamps records' own TTLs into the range allowed by MinTTL and MaxTTL
+// Records without their own TTL are left alone, as the default TTL is validated against the range at startup.
+func (r *Renderer) clampTTLs(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+	clamped := make([]*endpoint.Endpoint, 0, len(records))
+	for _, ep := range records {
+		ttl := ep.RecordTTL
+		if ttl.IsConfigured() && r.opts.MinTTL > 0 && ttl < r.opts.MinTTL {
+			ttl = r.opts.MinTTL
+		} else if ttl.IsConfigured() && r.opts.MaxTTL > 0 && ttl > r.opts.MaxTTL {
+			ttl = r.opts.MaxTTL
+		}
+		if ttl != ep.RecordTTL {
+			recordLog(ep).Debugf("Record \"%s\" (%s) has TTL %ds outside the allowed range. Using %ds.", ep.DNSName, ep.RecordType, ep.RecordTTL, ttl)
+			ep = ep.DeepCopy()
+			ep.RecordTTL = ttl
+		}
+		clamped = append(clamped, ep)
+	}
+	return clamped
+}
+
+// Ensures that records sharing a name and type agree on their TTL, as they form a single RRset (RFC 2181)
+// Where they disagree, the lowest TTL is used unless the strategy is split. Records are copied rather than modified.
+func (r *Renderer) reconcileTTLs(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+	if r.opts.TTLConflictStrategy == TTLConflictSplit {
+		return records
+	}
+
+	effectiveTTL := func(ep *endpoint.Endpoint) endpoint.TTL {
+		if ep.RecordTTL.IsConfigured() {
+			return ep.RecordTTL
+		}
+		return r.opts.DefaultTTL
+	}
+
+	lowest := make(map[string]endpoint.TTL, len(records))
+	conflicting := make(map[string]bool)
+	for _, ep := range records {
+		key := ep.DNSName + "/" + ep.RecordType
+		ttl := effectiveTTL(ep)
+		if current, ok := lowest[key]; !ok || ttl < current {
+			conflicting[key] = ok
+			lowest[key] = ttl
+		} else if ttl != current {
+			conflicting[key] = true
+		}
+	}
+
+	reconciled := make([]*endpoint.Endpoint, 0, len(records))
+	for _, ep := range records {
+		key := ep.DNSName + "/" + ep.RecordType
+		if conflicting[key] && effectiveTTL(ep) != lowest[key] {
+			recordLog(ep).Warnf("Record \"%s\" (%s) has conflicting TTLs. Using the lowest, %ds.", ep.DNSName, ep.RecordType, lowest[key])
+			ep = ep.DeepCopy()
+			ep.RecordTTL = lowest[key]
+		}
+		reconciled = append(reconciled, ep)
+	}
+
+	return reconciled
+}
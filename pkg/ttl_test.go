@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"testing"
+)
+
+func TestConflictingTTLs(t *testing.T) {
+	records := func() []*endpoint.Endpoint {
+		return []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpointWithTTL("a.example.com", endpoint.RecordTypeA, 60, "10.0.0.2"),
+		}
+	}
+
+	lowest := renderTest(t, StorageOptions{}, records()...)
+	assertContainsLines(t, lowest,
+		`answer "{{ .Name }} 60 IN A 10.0.0.1"`,
+		`answer "{{ .Name }} 60 IN A 10.0.0.2"`,
+	)
+	assertNotContains(t, lowest, "10.0.0.1 a.example.com")
+
+	split := renderTest(t, StorageOptions{TTLConflictStrategy: TTLConflictSplit}, records()...)
+	assertContainsLines(t, split,
+		"10.0.0.1 a.example.com",
+		`answer "{{ .Name }} 60 IN A 10.0.0.2"`,
+	)
+	assertNotContains(t, split, "60 IN A 10.0.0.1")
+}
+
+func TestClampTTLs(t *testing.T) {
+	config := renderTest(t, StorageOptions{MinTTL: 30, MaxTTL: 3600},
+		endpoint.NewEndpointWithTTL("low.example.com", endpoint.RecordTypeA, 5, "10.0.0.1"),
+		endpoint.NewEndpointWithTTL("high.example.com", endpoint.RecordTypeA, 86400, "10.0.0.2"),
+		endpoint.NewEndpointWithTTL("within.example.com", endpoint.RecordTypeA, 600, "10.0.0.3"),
+	)
+	assertContainsLines(t, config,
+		`answer "{{ .Name }} 30 IN A 10.0.0.1"`,
+		`answer "{{ .Name }} 3600 IN A 10.0.0.2"`,
+		`answer "{{ .Name }} 600 IN A 10.0.0.3"`,
+	)
+}
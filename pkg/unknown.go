@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"fmt"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"slices"
+)
+
+// How to handle records whose type isn't known to external-dns at all
+type UnknownTypePolicy string
+
+const (
+	// Drop the records, neither storing nor rendering them
+	UnknownTypeSkip UnknownTypePolicy = "skip"
+	// Store the records, but don't render them
+	UnknownTypeStore UnknownTypePolicy = "store"
+	// Refuse the whole change
+	UnknownTypeReject UnknownTypePolicy = "reject"
+)
+
+// UnknownTypePolicies lists the policies which can be selected
+var UnknownTypePolicies = []UnknownTypePolicy{UnknownTypeSkip, UnknownTypeStore, UnknownTypeReject}
+
+// Record types known to external-dns, whether or not we can render them
+var knownRecordTypes = []string{
+	endpoint.RecordTypeA,
+	endpoint.RecordTypeAAAA,
+	endpoint.RecordTypeCNAME,
+	endpoint.RecordTypeTXT,
+	endpoint.RecordTypeSRV,
+	endpoint.RecordTypeNS,
+	endpoint.RecordTypePTR,
+	endpoint.RecordTypeMX,
+	endpoint.RecordTypeNAPTR,
+	"SPF",
+}
+
+func isKnownRecordType(recordType string) bool {
+	return slices.Contains(knownRecordTypes, recordType)
+}
+
+// Applies the policy to the records being added by a plan
+// Deletions are left alone, so that records stored under a previous policy can still be removed
+func filterUnknownTypes(changes plan.Changes, policy UnknownTypePolicy) (plan.Changes, error) {
+	filter := func(records []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+		filtered := make([]*endpoint.Endpoint, 0, len(records))
+		for _, ep := range records {
+			if isKnownRecordType(ep.RecordType) {
+				filtered = append(filtered, ep)
+				continue
+			}
+			switch policy {
+			case UnknownTypeReject:
+				return nil, fmt.Errorf("record \"%s\" has unknown record type \"%s\"", ep.DNSName, ep.RecordType)
+			case UnknownTypeSkip:
+				recordLog(ep).Warnf("Record \"%s\" uses unknown record type \"%s\". Skipping.", ep.DNSName, ep.RecordType)
+			default:
+				filtered = append(filtered, ep)
+			}
+		}
+		return filtered, nil
+	}
+
+	var err error
+	if changes.Create, err = filter(changes.Create); err != nil {
+		return changes, err
+	}
+	if changes.UpdateNew, err = filter(changes.UpdateNew); err != nil {
+		return changes, err
+	}
+	return changes, nil
+}
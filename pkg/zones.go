@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"sigs.k8s.io/external-dns/endpoint"
+	"strings"
+)
+
+// An endpoint annotated with the zone it belongs to, for downstream consumers of the records key
+// The zone is ignored when unmarshalling back into an endpoint.Endpoint
+type zonedEndpoint struct {
+	*endpoint.Endpoint
+	Zone string `json:"zone,omitempty"`
+}
+
+// Finds the most specific zone containing the given name, or an empty string if there is none
+func findZone(zones []string, name string) string {
+	name = canonicalName(name)
+	best := ""
+	for _, zone := range zones {
+		zone = strings.Trim(strings.ToLower(zone), ".")
+		if zone == "" || len(zone) <= len(best) {
+			continue
+		}
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			best = zone
+		}
+	}
+	return best
+}
+
+// Returns the canonical form of a DNS name: lowercase, without a trailing dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Returns the records with canonical names, copying any which need to change
+func canonicalizeRecords(records []*endpoint.Endpoint) []*endpoint.Endpoint {
+	canonical := make([]*endpoint.Endpoint, 0, len(records))
+	for _, ep := range records {
+		if name := canonicalName(ep.DNSName); name != ep.DNSName {
+			ep = ep.DeepCopy()
+			ep.DNSName = name
+		}
+		canonical = append(canonical, ep)
+	}
+	return canonical
+}
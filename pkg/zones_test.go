@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"encoding/json"
+	"sigs.k8s.io/external-dns/endpoint"
+	"slices"
+	"testing"
+)
+
+func TestFindZone(t *testing.T) {
+	zones := []string{"example.com", "Sub.Example.com.", "example.org"}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"www.example.com", "example.com"},
+		{"a.sub.example.com", "sub.example.com"},
+		{"notexample.com", ""},
+		{"example.net", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findZone(zones, tt.name); got != tt.want {
+				t.Errorf("findZone(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotatedZonesRoundTrip(t *testing.T) {
+	s, client := newTestStorage(t, StorageOptions{DefaultTTL: 300, AnnotateZones: true, Zones: []string{"example.com", "sub.example.com"}})
+	records := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+		endpoint.NewEndpoint("b.sub.example.com", endpoint.RecordTypeA, "10.0.0.2"),
+	}
+	modifyTestRecords(t, s, func([]*endpoint.Endpoint) []*endpoint.Endpoint {
+		return records
+	})
+
+	var stored []struct {
+		DNSName string `json:"dnsName"`
+		Zone    string `json:"zone"`
+	}
+	if err := json.Unmarshal([]byte(getTestConfigMap(t, client, testName).Data["records"]), &stored); err != nil {
+		t.Fatal(err)
+	}
+	zones := map[string]string{}
+	for _, record := range stored {
+		zones[record.DNSName] = record.Zone
+	}
+	if zones["a.example.com"] != "example.com" || zones["b.sub.example.com"] != "sub.example.com" {
+		t.Errorf("stored zones %v, want each record's most specific zone", zones)
+	}
+
+	loaded := loadTestRecords(t, s)
+	if !slices.EqualFunc(loaded, records, func(a, b *endpoint.Endpoint) bool { return a.String() == b.String() }) {
+		t.Errorf("loaded %v, want %v", loaded, records)
+	}
+}